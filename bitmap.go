@@ -0,0 +1,549 @@
+package goutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Uint64Bitmap is a thread-safe compressed set of uint64s in the style of a
+// roaring bitmap: values are grouped by their upper 48 bits into containers of
+// 2^16 values each, stored as a sorted array while sparse and as a bitmap once
+// dense. Dense IDs take about one bit each instead of the ~40 bytes of a map
+// entry. The zero value is an empty bitmap ready to use.
+type Uint64Bitmap struct {
+	containers []*bitmapContainer // sorted by key
+	sync.RWMutex
+}
+
+// A container switches to a bitmap above this many values, where the array
+// would take more than the bitmap's 8KB.
+const bitmapArrayMax = 4096
+
+const bitmapWords = 1 << 16 / 64
+
+type bitmapContainer struct {
+	key   uint64 // upper 48 bits
+	n     int
+	array []uint16 // sorted, if bits is nil
+	bits  []uint64
+}
+
+func NewUint64Bitmap(vals ...uint64) *Uint64Bitmap {
+	b := &Uint64Bitmap{}
+	b.AddAll(vals...)
+	return b
+}
+
+// Bitmap returns the values of l as a Uint64Bitmap.
+func (l Uint64s) Bitmap() *Uint64Bitmap {
+	return NewUint64Bitmap(l...)
+}
+
+func bitmapSplit(v uint64) (uint64, uint16) {
+	return v >> 16, uint16(v)
+}
+
+// find returns the index of the container with key, or where it would go.
+func (b *Uint64Bitmap) find(key uint64) (int, bool) {
+	i := sort.Search(len(b.containers), func(i int) bool {
+		return b.containers[i].key >= key
+	})
+	return i, i < len(b.containers) && b.containers[i].key == key
+}
+
+// Add inserts v, reporting whether it was not in the bitmap yet.
+func (b *Uint64Bitmap) Add(v uint64) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.add(v)
+}
+
+// AddAll inserts all vals under a single lock.
+func (b *Uint64Bitmap) AddAll(vals ...uint64) {
+	b.Lock()
+	defer b.Unlock()
+	for _, v := range vals {
+		b.add(v)
+	}
+}
+
+func (b *Uint64Bitmap) add(v uint64) bool {
+	key, lo := bitmapSplit(v)
+	i, ok := b.find(key)
+	if !ok {
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &bitmapContainer{key: key}
+	}
+	return b.containers[i].add(lo)
+}
+
+// Remove deletes v, reporting whether it was in the bitmap.
+func (b *Uint64Bitmap) Remove(v uint64) bool {
+	b.Lock()
+	defer b.Unlock()
+	key, lo := bitmapSplit(v)
+	i, ok := b.find(key)
+	if !ok || !b.containers[i].remove(lo) {
+		return false
+	}
+	if b.containers[i].n == 0 {
+		b.containers = append(b.containers[:i], b.containers[i+1:]...)
+	}
+	return true
+}
+
+func (b *Uint64Bitmap) Contains(v uint64) bool {
+	b.RLock()
+	defer b.RUnlock()
+	key, lo := bitmapSplit(v)
+	i, ok := b.find(key)
+	return ok && b.containers[i].contains(lo)
+}
+
+// Cardinality returns the number of values in the bitmap.
+func (b *Uint64Bitmap) Cardinality() uint64 {
+	b.RLock()
+	defer b.RUnlock()
+	var n uint64
+	for _, c := range b.containers {
+		n += uint64(c.n)
+	}
+	return n
+}
+
+func (b *Uint64Bitmap) Len() int {
+	return int(b.Cardinality())
+}
+
+func (b *Uint64Bitmap) IsEmpty() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.containers) == 0
+}
+
+func (b *Uint64Bitmap) Clear() {
+	b.Lock()
+	defer b.Unlock()
+	b.containers = nil
+}
+
+// SizeInBytes estimates the memory used by the bitmap's values.
+func (b *Uint64Bitmap) SizeInBytes() int {
+	b.RLock()
+	defer b.RUnlock()
+	size := cap(b.containers) * int(unsafe.Sizeof(uintptr(0)))
+	for _, c := range b.containers {
+		size += int(unsafe.Sizeof(*c)) + cap(c.array)*2 + cap(c.bits)*8
+	}
+	return size
+}
+
+// Range calls f in ascending order for each value until f returns false. The
+// bitmap is read-locked meanwhile, so f must not modify it.
+func (b *Uint64Bitmap) Range(f func(v uint64) bool) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, c := range b.containers {
+		if !c.each(f) {
+			return
+		}
+	}
+}
+
+// Uint64s returns the values in ascending order.
+func (b *Uint64Bitmap) Uint64s() Uint64s {
+	b.RLock()
+	out := make(Uint64s, 0, b.cardinality())
+	b.RUnlock()
+	b.Range(func(v uint64) bool {
+		out = append(out, v)
+		return true
+	})
+	return out
+}
+
+func (b *Uint64Bitmap) cardinality() int {
+	n := 0
+	for _, c := range b.containers {
+		n += c.n
+	}
+	return n
+}
+
+func (b *Uint64Bitmap) Clone() *Uint64Bitmap {
+	b.RLock()
+	defer b.RUnlock()
+	out := &Uint64Bitmap{containers: make([]*bitmapContainer, len(b.containers))}
+	for i, c := range b.containers {
+		out.containers[i] = c.clone()
+	}
+	return out
+}
+
+// rlockBoth read-locks b and o in address order, so that concurrent
+// operations on the same pair cannot deadlock, and returns the unlock.
+func (b *Uint64Bitmap) rlockBoth(o *Uint64Bitmap) func() {
+	if b == o {
+		b.RLock()
+		return b.RUnlock
+	}
+	first, second := b, o
+	if uintptr(unsafe.Pointer(o)) < uintptr(unsafe.Pointer(b)) {
+		first, second = o, b
+	}
+	first.RLock()
+	second.RLock()
+	return func() {
+		second.RUnlock()
+		first.RUnlock()
+	}
+}
+
+// merge combines the containers of b and o with op, keeping containers of
+// only b if keepB and of only o if keepO.
+func (b *Uint64Bitmap) merge(o *Uint64Bitmap, keepB, keepO bool, op func(x, y *bitmapContainer) *bitmapContainer) *Uint64Bitmap {
+	defer b.rlockBoth(o)()
+	out := &Uint64Bitmap{}
+	i, j := 0, 0
+	for i < len(b.containers) || j < len(o.containers) {
+		var c *bitmapContainer
+		switch {
+		case j == len(o.containers) || (i < len(b.containers) && b.containers[i].key < o.containers[j].key):
+			if keepB {
+				c = b.containers[i].clone()
+			}
+			i++
+		case i == len(b.containers) || o.containers[j].key < b.containers[i].key:
+			if keepO {
+				c = o.containers[j].clone()
+			}
+			j++
+		default:
+			c = op(b.containers[i], o.containers[j])
+			i++
+			j++
+		}
+		if c != nil && c.n > 0 {
+			out.containers = append(out.containers, c)
+		}
+	}
+	return out
+}
+
+// Union returns a new bitmap of the values in b or o.
+func (b *Uint64Bitmap) Union(o *Uint64Bitmap) *Uint64Bitmap {
+	return b.merge(o, true, true, (*bitmapContainer).or)
+}
+
+// Intersect returns a new bitmap of the values in both b and o.
+func (b *Uint64Bitmap) Intersect(o *Uint64Bitmap) *Uint64Bitmap {
+	return b.merge(o, false, false, (*bitmapContainer).and)
+}
+
+// AndNot returns a new bitmap of the values in b but not in o.
+func (b *Uint64Bitmap) AndNot(o *Uint64Bitmap) *Uint64Bitmap {
+	return b.merge(o, true, false, (*bitmapContainer).andNot)
+}
+
+var errBitmapCorrupt = errors.New("goutil: corrupt Uint64Bitmap encoding")
+
+// MarshalBinary encodes the bitmap as the number of containers followed by
+// each container's key, cardinality, kind and contents, little-endian.
+func (b *Uint64Bitmap) MarshalBinary() ([]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+	out := appendUvarint(nil, uint64(len(b.containers)))
+	for _, c := range b.containers {
+		out = appendUvarint(out, c.key)
+		out = appendUvarint(out, uint64(c.n))
+		if c.bits != nil {
+			out = append(out, 1)
+			for _, w := range c.bits {
+				out = append(out, 0, 0, 0, 0, 0, 0, 0, 0)
+				binary.LittleEndian.PutUint64(out[len(out)-8:], w)
+			}
+		} else {
+			out = append(out, 0)
+			for _, v := range c.array {
+				out = append(out, byte(v), byte(v>>8))
+			}
+		}
+	}
+	return out, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (b *Uint64Bitmap) UnmarshalBinary(data []byte) error {
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errBitmapCorrupt
+		}
+		data = data[n:]
+		return v, nil
+	}
+	count, err := uvarint()
+	if err != nil {
+		return err
+	}
+	var containers []*bitmapContainer
+	for k := uint64(0); k < count; k++ {
+		c := &bitmapContainer{}
+		if c.key, err = uvarint(); err != nil {
+			return err
+		}
+		n, err := uvarint()
+		if err != nil || n == 0 || n > 1<<16 || len(data) == 0 {
+			return errBitmapCorrupt
+		}
+		c.n = int(n)
+		kind := data[0]
+		data = data[1:]
+		switch {
+		case kind == 1 && len(data) >= bitmapWords*8:
+			c.bits = make([]uint64, bitmapWords)
+			for i := range c.bits {
+				c.bits[i] = binary.LittleEndian.Uint64(data[i*8:])
+			}
+			data = data[bitmapWords*8:]
+			c.count()
+			if c.n != int(n) {
+				return errBitmapCorrupt
+			}
+		case kind == 0 && len(data) >= c.n*2:
+			c.array = make([]uint16, c.n)
+			for i := range c.array {
+				c.array[i] = binary.LittleEndian.Uint16(data[i*2:])
+				if i > 0 && c.array[i] <= c.array[i-1] {
+					return errBitmapCorrupt
+				}
+			}
+			data = data[c.n*2:]
+		default:
+			return errBitmapCorrupt
+		}
+		if c.key >= 1<<48 || (len(containers) > 0 && containers[len(containers)-1].key >= c.key) {
+			return errBitmapCorrupt
+		}
+		c.normalize()
+		containers = append(containers, c)
+	}
+	if len(data) != 0 {
+		return errBitmapCorrupt
+	}
+	b.Lock()
+	b.containers = containers
+	b.Unlock()
+	return nil
+}
+
+func (c *bitmapContainer) search(lo uint16) (int, bool) {
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	return i, i < len(c.array) && c.array[i] == lo
+}
+
+func (c *bitmapContainer) contains(lo uint16) bool {
+	if c.bits != nil {
+		return c.bits[lo/64]&(1<<(lo%64)) != 0
+	}
+	_, ok := c.search(lo)
+	return ok
+}
+
+func (c *bitmapContainer) add(lo uint16) bool {
+	if c.bits != nil {
+		w, bit := &c.bits[lo/64], uint64(1)<<(lo%64)
+		if *w&bit != 0 {
+			return false
+		}
+		*w |= bit
+		c.n++
+		return true
+	}
+	i, ok := c.search(lo)
+	if ok {
+		return false
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = lo
+	c.n++
+	c.normalize()
+	return true
+}
+
+func (c *bitmapContainer) remove(lo uint16) bool {
+	if c.bits != nil {
+		w, bit := &c.bits[lo/64], uint64(1)<<(lo%64)
+		if *w&bit == 0 {
+			return false
+		}
+		*w &^= bit
+		c.n--
+		c.normalize()
+		return true
+	}
+	i, ok := c.search(lo)
+	if !ok {
+		return false
+	}
+	c.array = append(c.array[:i], c.array[i+1:]...)
+	c.n--
+	return true
+}
+
+// normalize picks the smaller representation for the cardinality.
+func (c *bitmapContainer) normalize() {
+	switch {
+	case c.bits == nil && c.n > bitmapArrayMax:
+		c.bits = make([]uint64, bitmapWords)
+		for _, v := range c.array {
+			c.bits[v/64] |= 1 << (v % 64)
+		}
+		c.array = nil
+	case c.bits != nil && c.n <= bitmapArrayMax:
+		c.array = make([]uint16, 0, c.n)
+		c.each(func(v uint64) bool {
+			c.array = append(c.array, uint16(v))
+			return true
+		})
+		c.bits = nil
+	}
+}
+
+// each calls f with the full values of c in ascending order.
+func (c *bitmapContainer) each(f func(v uint64) bool) bool {
+	base := c.key << 16
+	if c.bits == nil {
+		for _, v := range c.array {
+			if !f(base | uint64(v)) {
+				return false
+			}
+		}
+		return true
+	}
+	for i, w := range c.bits {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if !f(base | uint64(i*64+t)) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+func (c *bitmapContainer) clone() *bitmapContainer {
+	out := &bitmapContainer{key: c.key, n: c.n}
+	if c.bits != nil {
+		out.bits = append([]uint64(nil), c.bits...)
+	} else {
+		out.array = append([]uint16(nil), c.array...)
+	}
+	return out
+}
+
+func (c *bitmapContainer) count() {
+	c.n = 0
+	for _, w := range c.bits {
+		c.n += bits.OnesCount64(w)
+	}
+}
+
+func (c *bitmapContainer) or(o *bitmapContainer) *bitmapContainer {
+	if c.bits == nil && o.bits == nil {
+		out := &bitmapContainer{key: c.key, array: make([]uint16, 0, len(c.array)+len(o.array))}
+		i, j := 0, 0
+		for i < len(c.array) || j < len(o.array) {
+			switch {
+			case j == len(o.array) || (i < len(c.array) && c.array[i] < o.array[j]):
+				out.array = append(out.array, c.array[i])
+				i++
+			case i == len(c.array) || o.array[j] < c.array[i]:
+				out.array = append(out.array, o.array[j])
+				j++
+			default:
+				out.array = append(out.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		out.n = len(out.array)
+		out.normalize()
+		return out
+	}
+	if c.bits == nil {
+		c, o = o, c
+	}
+	out := c.clone()
+	if o.bits != nil {
+		for i, w := range o.bits {
+			out.bits[i] |= w
+		}
+	} else {
+		for _, v := range o.array {
+			out.bits[v/64] |= 1 << (v % 64)
+		}
+	}
+	out.count()
+	return out
+}
+
+func (c *bitmapContainer) and(o *bitmapContainer) *bitmapContainer {
+	if c.bits != nil && o.bits != nil {
+		out := c.clone()
+		for i, w := range o.bits {
+			out.bits[i] &= w
+		}
+		out.count()
+		out.normalize()
+		return out
+	}
+	if c.bits != nil {
+		c, o = o, c
+	}
+	out := &bitmapContainer{key: c.key}
+	for _, v := range c.array {
+		if o.contains(v) {
+			out.array = append(out.array, v)
+		}
+	}
+	out.n = len(out.array)
+	return out
+}
+
+func (c *bitmapContainer) andNot(o *bitmapContainer) *bitmapContainer {
+	if c.bits == nil {
+		out := &bitmapContainer{key: c.key}
+		for _, v := range c.array {
+			if !o.contains(v) {
+				out.array = append(out.array, v)
+			}
+		}
+		out.n = len(out.array)
+		return out
+	}
+	out := c.clone()
+	if o.bits != nil {
+		for i, w := range o.bits {
+			out.bits[i] &^= w
+		}
+	} else {
+		for _, v := range o.array {
+			out.bits[v/64] &^= 1 << (v % 64)
+		}
+	}
+	out.count()
+	out.normalize()
+	return out
+}
@@ -0,0 +1,219 @@
+package goutil
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestUint64Bitmap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ref := func(n int, max uint64) map[uint64]bool {
+		m := make(map[uint64]bool)
+		for i := 0; i < n; i++ {
+			m[uint64(rng.Int63n(int64(max)))] = true
+		}
+		return m
+	}
+	toBitmap := func(m map[uint64]bool) *Uint64Bitmap {
+		b := NewUint64Bitmap()
+		for v := range m {
+			b.Add(v)
+		}
+		return b
+	}
+	sorted := func(m map[uint64]bool) Uint64s {
+		l := make(Uint64s, 0, len(m))
+		for v := range m {
+			l = append(l, v)
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		return l
+	}
+	// dense and sparse containers, and containers present on one side only
+	x, y := ref(50000, 1<<18), ref(3000, 1<<20)
+	bx, by := toBitmap(x), toBitmap(y)
+	if got := bx.Uint64s(); !reflect.DeepEqual(got, sorted(x)) {
+		t.Fatal("Uint64s does not match the added values")
+	}
+	union, inter, diff := make(map[uint64]bool), make(map[uint64]bool), make(map[uint64]bool)
+	for v := range x {
+		union[v] = true
+		if y[v] {
+			inter[v] = true
+		} else {
+			diff[v] = true
+		}
+	}
+	for v := range y {
+		union[v] = true
+	}
+	for name, c := range map[string]struct {
+		got  *Uint64Bitmap
+		want map[uint64]bool
+	}{
+		"union":     {bx.Union(by), union},
+		"intersect": {bx.Intersect(by), inter},
+		"andnot":    {bx.AndNot(by), diff},
+		"self":      {bx.Intersect(bx), x},
+	} {
+		if c.got.Cardinality() != uint64(len(c.want)) || !reflect.DeepEqual(c.got.Uint64s(), sorted(c.want)) {
+			t.Errorf("%s has %d values, want %d", name, c.got.Cardinality(), len(c.want))
+		}
+	}
+
+	for v := range x {
+		if !bx.Remove(v) {
+			t.Fatalf("Remove(%d) found nothing", v)
+		}
+		delete(x, v)
+		if len(x) == 10 {
+			break
+		}
+	}
+	if got := bx.Uint64s(); !reflect.DeepEqual(got, sorted(x)) {
+		t.Errorf("%v left after removals, want %v", got, sorted(x))
+	}
+
+	data, err := by.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var round Uint64Bitmap
+	if err := round.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(round.Uint64s(), by.Uint64s()) {
+		t.Error("binary round trip changed the values")
+	}
+	if err := round.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("truncated encoding decoded without error")
+	}
+}
+
+const benchIDs = 1 << 20
+
+func BenchmarkUint64BitmapAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		bm := NewUint64Bitmap()
+		for v := uint64(0); v < benchIDs; v++ {
+			bm.Add(v)
+		}
+	}
+}
+
+func BenchmarkUint64SetAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s := NewUint64Set()
+		for v := uint64(0); v < benchIDs; v++ {
+			s.Add(v)
+		}
+	}
+}
+
+func BenchmarkUint64BitmapContains(b *testing.B) {
+	bm := NewUint64Bitmap()
+	for v := uint64(0); v < benchIDs; v += 2 {
+		bm.Add(v)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bm.Contains(uint64(i) % benchIDs)
+	}
+}
+
+func BenchmarkUint64SetContains(b *testing.B) {
+	s := NewUint64Set()
+	for v := uint64(0); v < benchIDs; v += 2 {
+		s.Add(v)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Has(uint64(i) % benchIDs)
+	}
+}
+
+func BenchmarkUint64BitmapIntersect(b *testing.B) {
+	x, y := NewUint64Bitmap(), NewUint64Bitmap()
+	for v := uint64(0); v < benchIDs; v++ {
+		if v%2 == 0 {
+			x.Add(v)
+		}
+		if v%3 == 0 {
+			y.Add(v)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Intersect(y)
+	}
+}
+
+func BenchmarkUint64SetIntersect(b *testing.B) {
+	x, y := NewUint64Set(), NewUint64Set()
+	for v := uint64(0); v < benchIDs; v++ {
+		if v%2 == 0 {
+			x.Add(v)
+		}
+		if v%3 == 0 {
+			y.Add(v)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Intersect(&y.Set)
+	}
+}
+
+func TestUint64BitmapUnmarshalCorrupt(t *testing.T) {
+	// encode builds a single container encoding with the given header.
+	encode := func(key, n uint64, kind byte, body []byte) []byte {
+		out := appendUvarint(appendUvarint(appendUvarint(nil, 1), key), n)
+		return append(append(out, kind), body...)
+	}
+	array := func(vals ...uint16) []byte {
+		var out []byte
+		for _, v := range vals {
+			out = append(out, byte(v), byte(v>>8))
+		}
+		return out
+	}
+	oneBit := make([]byte, bitmapWords*8)
+	oneBit[0] = 1
+
+	for name, data := range map[string][]byte{
+		"duplicate value":   encode(0, 2, 0, array(5, 5)),
+		"unsorted array":    encode(0, 2, 0, array(5, 3)),
+		"wrong bit count":   encode(0, 3, 1, oneBit),
+		"key over 48 bits":  encode(1<<48, 1, 0, array(1)),
+		"trailing bytes":    append(encode(0, 1, 0, array(1)), 0),
+		"unknown kind":      encode(0, 1, 2, array(1)),
+		"empty container":   encode(0, 0, 0, nil),
+		"truncated bitmaps": encode(0, 1, 1, oneBit[:8]),
+	} {
+		var b Uint64Bitmap
+		if err := b.UnmarshalBinary(data); err != errBitmapCorrupt {
+			t.Errorf("%s: UnmarshalBinary returned %v", name, err)
+		}
+	}
+
+	// containers are converted to the representation their size calls for
+	var b Uint64Bitmap
+	if err := b.UnmarshalBinary(encode(0, 1, 1, oneBit)); err != nil {
+		t.Fatal(err)
+	}
+	if c := b.containers[0]; c.bits != nil || !reflect.DeepEqual(c.array, []uint16{0}) {
+		t.Errorf("sparse bitmap container decoded as %+v", c)
+	}
+	dense := make([]uint16, bitmapArrayMax+1)
+	for i := range dense {
+		dense[i] = uint16(i)
+	}
+	if err := b.UnmarshalBinary(encode(0, uint64(len(dense)), 0, array(dense...))); err != nil {
+		t.Fatal(err)
+	}
+	if c := b.containers[0]; c.bits == nil || c.array != nil || b.Cardinality() != uint64(len(dense)) {
+		t.Errorf("dense array container decoded with %d values, bitmap %v", b.Cardinality(), c.bits != nil)
+	}
+}
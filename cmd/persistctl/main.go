@@ -0,0 +1,92 @@
+// Command persistctl backs up, restores, exports and imports persist stores.
+//
+// Usage:
+//
+//	persistctl [-C dir] backup  <key> [file]
+//	persistctl [-C dir] restore <key> [file]
+//	persistctl [-C dir] export  <key> [file]
+//	persistctl [-C dir] import  <key> [file]
+//
+// Stores are resolved as .store/<key> relative to dir. A missing file or "-"
+// means stdout for backup/export and stdin for restore/import. Exports keep
+// values in their stored encoding, since the value types are only known to the
+// owning program; use PersistentStringMap.Export for decoded JSON.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alexi/goutil/persist"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: persistctl [-C dir] backup|restore|export|import <key> [file]")
+	flag.PrintDefaults()
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func run(cmd, key, path string) error {
+	switch cmd {
+	case "backup", "export":
+		w, err := openOutput(path)
+		if err != nil {
+			return err
+		}
+		if cmd == "backup" {
+			err = persist.Backup(key, w)
+		} else {
+			err = persist.ExportRaw(key, w)
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case "restore", "import":
+		r, err := openInput(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if cmd == "restore" {
+			return persist.Restore(key, r)
+		}
+		return persist.ImportRaw(key, r)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func main() {
+	dir := flag.String("C", "", "directory containing the .store directory")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		usage()
+		os.Exit(2)
+	}
+	if *dir != "" {
+		if err := os.Chdir(*dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0), flag.Arg(1), flag.Arg(2)); err != nil {
+		fmt.Fprintln(os.Stderr, "persistctl:", err)
+		os.Exit(1)
+	}
+}
@@ -1,9 +1,19 @@
 package goutil
 
-import "sync"
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Uint64Counter struct {
-	m map[uint64]int
+	m     map[uint64]int
+	total int
+	// decay mode: counts are halved once per half-life
+	halfLife  int64 // time.Duration, accessed atomically
+	lastDecay time.Time
 	sync.RWMutex
 }
 
@@ -13,28 +23,185 @@ func NewUint64Counter() *Uint64Counter {
 	}
 }
 
-func (s *Uint64Counter) Increment(k uint64) {
+// NewDecayingUint64Counter returns a counter whose counts halve every
+// halfLife, so that ranking with TopK favours recently hot keys.
+func NewDecayingUint64Counter(halfLife time.Duration) *Uint64Counter {
+	s := NewUint64Counter()
+	s.SetHalfLife(halfLife)
+	return s
+}
+
+// SetHalfLife turns decay mode on, or off with zero.
+func (s *Uint64Counter) SetHalfLife(halfLife time.Duration) {
 	s.Lock()
 	defer s.Unlock()
-	s.m[k] += 1
+	s.decay(time.Now())
+	atomic.StoreInt64(&s.halfLife, int64(halfLife))
+	s.lastDecay = time.Now()
 }
 
-func (s *Uint64Counter) Decrement(k uint64) {
+// decay halves the counts for each half-life passed since the last decay,
+// dropping those that reach zero. Must be called with the write lock held.
+func (s *Uint64Counter) decay(now time.Time) {
+	halfLife := time.Duration(atomic.LoadInt64(&s.halfLife))
+	if halfLife <= 0 {
+		return
+	}
+	n := now.Sub(s.lastDecay) / halfLife
+	if n < 1 {
+		return
+	}
+	s.lastDecay = s.lastDecay.Add(n * halfLife)
+	s.total = 0
+	for k, c := range s.m {
+		if n < 63 {
+			c >>= uint(n)
+		} else {
+			c = 0
+		}
+		if c == 0 {
+			delete(s.m, k)
+			continue
+		}
+		s.m[k] = c
+		s.total += c
+	}
+}
+
+// lock takes the write lock and applies any decay due.
+func (s *Uint64Counter) lock() {
 	s.Lock()
+	if atomic.LoadInt64(&s.halfLife) > 0 {
+		s.decay(time.Now())
+	}
+}
+
+// rlock read-locks the counter for reading. In decay mode, pending decay has
+// to be applied first, which takes the write lock.
+func (s *Uint64Counter) rlock() (unlock func()) {
+	if atomic.LoadInt64(&s.halfLife) > 0 {
+		s.lock()
+		return s.Unlock
+	}
+	s.RLock()
+	return s.RUnlock
+}
+
+func (s *Uint64Counter) Increment(k uint64) {
+	s.Add(k, 1)
+}
+
+// Decrement lowers the count of k, removing k once it reaches zero.
+func (s *Uint64Counter) Decrement(k uint64) {
+	s.Add(k, -1)
+}
+
+// Add adds n, which may be negative, to the count of k. Counts do not go
+// below zero, and keys whose count reaches zero are removed.
+func (s *Uint64Counter) Add(k uint64, n int) {
+	s.lock()
 	defer s.Unlock()
-	if s.m[k] > 0 {
-		s.m[k] -= 1
+	old := s.m[k]
+	c := old + n
+	if c <= 0 {
+		delete(s.m, k)
+		c = 0
+	} else {
+		s.m[k] = c
 	}
+	s.total += c - old
 }
 
 func (s *Uint64Counter) Remove(k uint64) {
-	s.Lock()
+	s.lock()
 	defer s.Unlock()
+	s.total -= s.m[k]
 	delete(s.m, k)
 }
 
 func (s *Uint64Counter) Get(k uint64) int {
-	s.RLock()
-	defer s.RUnlock()
+	defer s.rlock()()
 	return s.m[k]
 }
+
+// Total returns the sum of all counts.
+func (s *Uint64Counter) Total() int {
+	defer s.rlock()()
+	return s.total
+}
+
+// Len returns the number of keys with a non-zero count.
+func (s *Uint64Counter) Len() int {
+	defer s.rlock()()
+	return len(s.m)
+}
+
+// Snapshot returns a copy of the counts.
+func (s *Uint64Counter) Snapshot() map[uint64]int {
+	defer s.rlock()()
+	out := make(map[uint64]int, len(s.m))
+	for k, c := range s.m {
+		out[k] = c
+	}
+	return out
+}
+
+// Range calls f for each key and count until f returns false. The counter is
+// locked meanwhile, so f must not modify it.
+func (s *Uint64Counter) Range(f func(k uint64, count int) bool) {
+	defer s.rlock()()
+	for k, c := range s.m {
+		if !f(k, c) {
+			return
+		}
+	}
+}
+
+type Uint64Count struct {
+	Key   uint64 `json:"key"`
+	Count int    `json:"count"`
+}
+
+// uint64CountHeap is a min-heap of the highest counts seen so far.
+type uint64CountHeap []Uint64Count
+
+func (h uint64CountHeap) Len() int            { return len(h) }
+func (h uint64CountHeap) Less(i, j int) bool  { return countLess(h[i], h[j]) }
+func (h uint64CountHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *uint64CountHeap) Push(x interface{}) { *h = append(*h, x.(Uint64Count)) }
+func (h *uint64CountHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// countLess orders by count, then by descending key so that smaller keys win
+// ties.
+func countLess(a, b Uint64Count) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.Key > b.Key
+}
+
+// TopK returns the k keys with the highest counts, highest first, in
+// O(n log k).
+func (s *Uint64Counter) TopK(k int) []Uint64Count {
+	if k <= 0 {
+		return nil
+	}
+	h := make(uint64CountHeap, 0, k)
+	s.Range(func(key uint64, count int) bool {
+		c := Uint64Count{key, count}
+		if len(h) < k {
+			heap.Push(&h, c)
+		} else if countLess(h[0], c) {
+			h[0] = c
+			heap.Fix(&h, 0)
+		}
+		return true
+	})
+	sort.Slice(h, func(i, j int) bool { return countLess(h[j], h[i]) })
+	return h
+}
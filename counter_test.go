@@ -0,0 +1,120 @@
+package goutil
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUint64Counter(t *testing.T) {
+	c := NewUint64Counter()
+	for k := uint64(1); k <= 10; k++ {
+		c.Add(k, int(k))
+	}
+	c.Increment(3)
+	c.Decrement(1)
+	c.Add(2, -5)
+	if c.Len() != 8 || c.Get(1) != 0 || c.Get(2) != 0 {
+		t.Errorf("zero counts not removed: %v", c.Snapshot())
+	}
+	if want := 55 - 1 - 2 + 1; c.Total() != want {
+		t.Errorf("total %d, want %d", c.Total(), want)
+	}
+	c.Add(4, 5) // ties with 9
+	want := []Uint64Count{{10, 10}, {4, 9}, {9, 9}}
+	if got := c.TopK(3); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopK(3) = %v, want %v", got, want)
+	}
+	if got := c.TopK(100); len(got) != c.Len() {
+		t.Errorf("TopK beyond Len returned %d entries", len(got))
+	}
+}
+
+func TestUint64CounterDecay(t *testing.T) {
+	const halfLife = time.Hour
+	c := NewDecayingUint64Counter(halfLife)
+	c.Add(1, 8)
+	c.Add(2, 1)
+	// move the last decay back rather than sleeping, so the test does not
+	// depend on the scheduler
+	c.Lock()
+	c.lastDecay = c.lastDecay.Add(-halfLife * 3 / 2)
+	c.Unlock()
+	if c.Get(1) != 4 || c.Len() != 1 || c.Total() != 4 {
+		t.Errorf("after one half-life: %v, total %d", c.Snapshot(), c.Total())
+	}
+	c.Add(3, 5)
+	if top := c.TopK(1); top[0].Key != 3 {
+		t.Errorf("recently hot key not ranked first: %v", top)
+	}
+}
+
+func TestShardedUint64Counter(t *testing.T) {
+	s := NewShardedUint64Counter(8)
+	c := NewStripedCounter()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := uint64(0); k < 100; k++ {
+				s.Add(k, int(k))
+				c.Increment()
+			}
+		}()
+	}
+	wg.Wait()
+	if s.Len() != 99 || s.Total() != 8*4950 || s.Get(7) != 56 {
+		t.Errorf("len %d, total %d, count of 7 %d", s.Len(), s.Total(), s.Get(7))
+	}
+	want := []Uint64Count{{99, 792}, {98, 784}}
+	if got := s.TopK(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopK(2) = %v, want %v", got, want)
+	}
+	if n := c.Get(); n != 800 {
+		t.Errorf("striped counter is %d, want 800", n)
+	}
+	if n := c.Reset(); n != 800 || c.Get() != 0 {
+		t.Errorf("Reset returned %d and left %d", n, c.Get())
+	}
+}
+
+// Run with -cpu 1,2,4,8 to compare how the counters scale with GOMAXPROCS.
+
+func BenchmarkUint64CounterParallel(b *testing.B) {
+	c := NewUint64Counter()
+	b.RunParallel(func(pb *testing.PB) {
+		for k := uint64(0); pb.Next(); k++ {
+			c.Increment(k % 1024)
+		}
+	})
+}
+
+func BenchmarkShardedUint64CounterParallel(b *testing.B) {
+	c := NewShardedUint64Counter(0)
+	b.RunParallel(func(pb *testing.PB) {
+		for k := uint64(0); pb.Next(); k++ {
+			c.Increment(k % 1024)
+		}
+	})
+}
+
+func BenchmarkAtomicCounterParallel(b *testing.B) {
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			atomic.AddInt64(&n, 1)
+		}
+	})
+}
+
+func BenchmarkStripedCounterParallel(b *testing.B) {
+	c := NewStripedCounter()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Increment()
+		}
+	})
+}
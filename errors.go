@@ -3,6 +3,9 @@ package goutil
 import "errors"
 
 var (
-	ErrNotFound   = errors.New("Not found")
-	ErrOutOfRange = errors.New("Out of range")
+	ErrNotFound     = errors.New("Not found")
+	ErrOutOfRange   = errors.New("Out of range")
+	ErrNotLocked    = errors.New("Not locked")
+	ErrExceedsBurst = errors.New("Exceeds burst")
+	ErrBadWeight    = errors.New("Weight must be at least 1")
 )
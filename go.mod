@@ -1,6 +1,6 @@
 module github.com/alexi/goutil
 
-go 1.16
+go 1.18
 
 require (
 	github.com/dgraph-io/badger v1.6.2
@@ -11,3 +11,15 @@ require (
 	github.com/shirou/gopsutil/v3 v3.21.1
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/dgraph-io/ristretto v0.0.2 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/montanaflynn/stats v0.5.0 // indirect
+	github.com/ncw/directio v1.0.5 // indirect
+	golang.org/x/net v0.0.0-20201216054612-986b41b23924 // indirect
+	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073 // indirect
+	google.golang.org/protobuf v1.23.0 // indirect
+)
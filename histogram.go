@@ -0,0 +1,234 @@
+package goutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets split every power of two into histSubBuckets linear
+// sub-buckets, so quantiles are reported within 1/histSubBuckets (12.5%) of the
+// recorded values while the whole int64 range fits in a few KB.
+const (
+	histSubBits    = 3
+	histSubBuckets = 1 << histSubBits
+	histBuckets    = (64 - histSubBits) * histSubBuckets
+)
+
+// Histogram is a log-bucketed latency histogram created by NewHistogram.
+// Record and Merge are lock-free and safe for concurrent use.
+type Histogram struct {
+	counts [histBuckets]int64
+	count  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+type HistogramSummary struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min"`
+	Max   time.Duration `json:"max"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{min: math.MaxInt64}
+}
+
+func histBucket(v int64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - histSubBits - 1
+	return (shift+1)*histSubBuckets + int(v>>uint(shift)) - histSubBuckets
+}
+
+// histBucketBounds returns the smallest and largest value falling in bucket i.
+func histBucketBounds(i int) (int64, int64) {
+	if i < histSubBuckets {
+		return int64(i), int64(i)
+	}
+	shift := uint(i/histSubBuckets - 1)
+	lo := int64(histSubBuckets+i%histSubBuckets) << shift
+	return lo, lo + (int64(1) << shift) - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	atomic.AddInt64(&h.counts[histBucket(v)], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, v)
+	h.updateMin(v)
+	h.updateMax(v)
+}
+
+func (h *Histogram) updateMin(v int64) {
+	for {
+		old := atomic.LoadInt64(&h.min)
+		if v >= old || atomic.CompareAndSwapInt64(&h.min, old, v) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) updateMax(v int64) {
+	for {
+		old := atomic.LoadInt64(&h.max)
+		if v <= old || atomic.CompareAndSwapInt64(&h.max, old, v) {
+			return
+		}
+	}
+}
+
+// Merge adds the recorded values of others into h.
+func (h *Histogram) Merge(others ...*Histogram) *Histogram {
+	if h == nil {
+		return nil
+	}
+	for _, o := range others {
+		if o == nil || o == h {
+			continue
+		}
+		n := atomic.LoadInt64(&o.count)
+		if n == 0 {
+			continue
+		}
+		for i := range o.counts {
+			if c := atomic.LoadInt64(&o.counts[i]); c != 0 {
+				atomic.AddInt64(&h.counts[i], c)
+			}
+		}
+		atomic.AddInt64(&h.count, n)
+		atomic.AddInt64(&h.sum, atomic.LoadInt64(&o.sum))
+		h.updateMin(atomic.LoadInt64(&o.min))
+		h.updateMax(atomic.LoadInt64(&o.max))
+	}
+	return h
+}
+
+// collect moves the recorded values into a new histogram and resets h. Values
+// recorded concurrently land in either h or the result, never in neither.
+func (h *Histogram) collect() *Histogram {
+	if h == nil {
+		return nil
+	}
+	out := NewHistogram()
+	for i := range h.counts {
+		out.counts[i] = atomic.SwapInt64(&h.counts[i], 0)
+	}
+	out.count = atomic.SwapInt64(&h.count, 0)
+	out.sum = atomic.SwapInt64(&h.sum, 0)
+	out.min = atomic.SwapInt64(&h.min, math.MaxInt64)
+	out.max = atomic.SwapInt64(&h.max, 0)
+	return out
+}
+
+// reset clears h in place.
+func (h *Histogram) reset() {
+	if h == nil {
+		return
+	}
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.count, 0)
+	atomic.StoreInt64(&h.sum, 0)
+	atomic.StoreInt64(&h.min, math.MaxInt64)
+	atomic.StoreInt64(&h.max, 0)
+}
+
+func (h *Histogram) Count() int64 {
+	if h == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&h.count)
+}
+
+func (h *Histogram) Min() time.Duration {
+	if h.Count() == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&h.min))
+}
+
+func (h *Histogram) Max() time.Duration {
+	if h.Count() == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&h.max))
+}
+
+// Quantile returns an estimate of the q-th quantile (0 <= q <= 1) of the
+// recorded values.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h == nil {
+		return 0
+	}
+	var counts [histBuckets]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank {
+			lo, hi := histBucketBounds(i)
+			v := lo + (hi-lo)/2
+			if min := atomic.LoadInt64(&h.min); v < min {
+				v = min
+			}
+			if max := atomic.LoadInt64(&h.max); v > max {
+				v = max
+			}
+			return time.Duration(v)
+		}
+	}
+	return h.Max()
+}
+
+func (h *Histogram) Summary() HistogramSummary {
+	n := h.Count()
+	if n == 0 {
+		return HistogramSummary{}
+	}
+	return HistogramSummary{
+		Count: n,
+		Min:   h.Min(),
+		Max:   h.Max(),
+		Mean:  time.Duration(atomic.LoadInt64(&h.sum) / n),
+		P50:   h.Quantile(0.5),
+		P90:   h.Quantile(0.9),
+		P99:   h.Quantile(0.99),
+	}
+}
+
+func (h *Histogram) String() string {
+	s := h.Summary()
+	return fmt.Sprintf("min: %v, max: %v, p50: %v, p90: %v, p99: %v", s.Min, s.Max, s.P50, s.P90, s.P99)
+}
+
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Summary())
+}
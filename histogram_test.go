@@ -0,0 +1,81 @@
+package goutil
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Millisecond}, {0.9, 900 * time.Millisecond}, {0.99, 990 * time.Millisecond}} {
+		got := h.Quantile(tc.q)
+		if got < tc.want*7/8 || got > tc.want*9/8 {
+			t.Errorf("p%v = %v, want within 12.5%% of %v", tc.q*100, got, tc.want)
+		}
+	}
+	if h.Min() != time.Millisecond || h.Max() != time.Second {
+		t.Errorf("min/max = %v/%v", h.Min(), h.Max())
+	}
+	merged := NewHistogram().Merge(h, h)
+	if merged.Count() != 2000 || merged.Quantile(0.5) != h.Quantile(0.5) {
+		t.Errorf("merged count %d p50 %v", merged.Count(), merged.Quantile(0.5))
+	}
+}
+
+func TestOpTraceHistogram(t *testing.T) {
+	root := NewOpTrace("root")
+	child := root.AddNewChild("child")
+	// Run with -race: histograms can be enabled while the trace is in use.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			child.Add(time.Millisecond)
+		}
+	}()
+	root.EnableHistograms()
+	<-done
+
+	root.EnableHistograms() // keeps the existing histograms
+	h := child.GetHistogram()
+	for i := 1; i <= 100; i++ {
+		child.Add(time.Duration(i) * time.Millisecond)
+	}
+	if child.GetHistogram() != h || h.Count() < 100 {
+		t.Fatalf("histogram holds %d calls", h.Count())
+	}
+	if root.AddNewChild("late").GetHistogram() == nil {
+		t.Error("child added after EnableHistograms has no histogram")
+	}
+
+	for _, field := range []string{"min: ", "max: 100ms", "p50: ", "p90: ", "p99: "} {
+		if s := root.String(); !strings.Contains(s, field) {
+			t.Errorf("String lacks %q:\n%s", field, s)
+		}
+	}
+	b, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Children []struct {
+			Histogram *HistogramSummary `json:"histogram"`
+		} `json:"children"`
+	}
+	if err = json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	s := out.Children[0].Histogram
+	if s == nil || s.Count != h.Count() || s.Max != 100*time.Millisecond || s.Min <= 0 ||
+		s.P50 <= 0 || s.P50 > s.P90 || s.P90 > s.P99 || s.P99 > s.Max {
+		t.Errorf("histogram JSON = %+v\n%s", s, b)
+	}
+}
@@ -0,0 +1,301 @@
+package goutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lock debugging records every acquisition of a KeyedMutex key, an
+// OptionalRWMutex, a TimeoutMutex or a TimeoutRWMutex while enabled, to find
+// locks that are never released and pairs of locks taken in opposite orders.
+// It captures a stack trace per acquisition, so only enable it while
+// investigating.
+
+type LockDebugOptions struct {
+	// Locks held longer than this are reported once per acquisition; zero
+	// disables the check.
+	HoldThreshold time.Duration
+	// How often holds are compared to HoldThreshold; defaults to a quarter of
+	// it.
+	CheckInterval time.Duration
+	// Receives reports; prints to stderr if nil. log.EnableLockDebug reports
+	// through the log package.
+	Report func(v ...interface{})
+}
+
+type LockHolder struct {
+	Lock      string    `json:"lock"`
+	Write     bool      `json:"write"`
+	Goroutine uint64    `json:"goroutine"`
+	Since     time.Time `json:"since"`
+	Stack     string    `json:"stack"`
+	reported  bool
+}
+
+type lockDebugState struct {
+	opts    LockDebugOptions
+	mu      sync.Mutex
+	holders map[string][]*LockHolder
+	// locks held per goroutine, in acquisition order
+	held map[uint64][]string
+	// edges[a][b] is the stack that first acquired b while holding a
+	edges    map[string]map[string]string
+	inverted map[[2]string]bool
+	stop     chan struct{}
+}
+
+var (
+	lockDebugOn int32
+	lockDebugMu sync.Mutex
+	lockDebug   *lockDebugState
+)
+
+// EnableLockDebug starts recording lock acquisitions, replacing any previous
+// configuration.
+func EnableLockDebug(opts LockDebugOptions) {
+	if opts.Report == nil {
+		opts.Report = func(v ...interface{}) {
+			fmt.Fprintln(os.Stderr, v...)
+		}
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = opts.HoldThreshold / 4
+	}
+	if opts.CheckInterval < time.Millisecond {
+		opts.CheckInterval = time.Millisecond
+	}
+	s := &lockDebugState{
+		opts:     opts,
+		holders:  make(map[string][]*LockHolder),
+		held:     make(map[uint64][]string),
+		edges:    make(map[string]map[string]string),
+		inverted: make(map[[2]string]bool),
+		stop:     make(chan struct{}),
+	}
+	DisableLockDebug()
+	lockDebugMu.Lock()
+	defer lockDebugMu.Unlock()
+	lockDebug = s
+	atomic.StoreInt32(&lockDebugOn, 1)
+	if opts.HoldThreshold > 0 {
+		go s.watch()
+	}
+}
+
+// DisableLockDebug stops recording and forgets all recorded state.
+func DisableLockDebug() {
+	lockDebugMu.Lock()
+	defer lockDebugMu.Unlock()
+	atomic.StoreInt32(&lockDebugOn, 0)
+	if lockDebug != nil {
+		close(lockDebug.stop)
+		lockDebug = nil
+	}
+}
+
+func LockDebugEnabled() bool {
+	return atomic.LoadInt32(&lockDebugOn) == 1
+}
+
+func getLockDebug() *lockDebugState {
+	if !LockDebugEnabled() {
+		return nil
+	}
+	lockDebugMu.Lock()
+	defer lockDebugMu.Unlock()
+	return lockDebug
+}
+
+// LockHolders returns the current holders of debugged locks, longest held
+// first.
+func LockHolders() []LockHolder {
+	s := getLockDebug()
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	var out []LockHolder
+	for _, hs := range s.holders {
+		for _, h := range hs {
+			out = append(out, *h)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Since.Before(out[j].Since)
+	})
+	return out
+}
+
+// DumpLockHolders formats LockHolders for logging.
+func DumpLockHolders() string {
+	holders := LockHolders()
+	if len(holders) == 0 {
+		return "no debugged locks held"
+	}
+	var b strings.Builder
+	now := time.Now()
+	for _, h := range holders {
+		mode := "read"
+		if h.Write {
+			mode = "write"
+		}
+		fmt.Fprintf(&b, "%s (%s) held by goroutine %d for %v:\n%s\n", h.Lock, mode, h.Goroutine, now.Sub(h.Since), h.Stack)
+	}
+	return b.String()
+}
+
+func goroutineID(stack []byte) uint64 {
+	// "goroutine 123 [running]:"
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		id, _ := strconv.ParseUint(string(stack[:i]), 10, 64)
+		return id
+	}
+	return 0
+}
+
+func callerStack() (uint64, string) {
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	return goroutineID(buf), string(buf)
+}
+
+// debugLockWait checks that acquiring lock now is consistent with the order
+// other goroutines acquired it in. It is called before blocking, so actual
+// deadlocks get reported.
+func debugLockWait(lock string) {
+	s := getLockDebug()
+	if s == nil {
+		return
+	}
+	gid, stack := callerStack()
+	s.mu.Lock()
+	var reports []string
+	for _, h := range s.held[gid] {
+		if h == lock {
+			continue
+		}
+		if other, ok := s.edges[lock][h]; ok {
+			pair := [2]string{h, lock}
+			if h > lock {
+				pair = [2]string{lock, h}
+			}
+			if !s.inverted[pair] {
+				s.inverted[pair] = true
+				reports = append(reports, fmt.Sprintf("lock order inversion: %s acquired while holding %s at:\n%s\nbut %s was acquired while holding %s at:\n%s",
+					lock, h, stack, h, lock, other))
+			}
+		}
+		if s.edges[h] == nil {
+			s.edges[h] = make(map[string]string)
+		}
+		if _, ok := s.edges[h][lock]; !ok {
+			s.edges[h][lock] = stack
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range reports {
+		s.opts.Report(r)
+	}
+}
+
+func debugLocked(lock string, write bool) {
+	s := getLockDebug()
+	if s == nil {
+		return
+	}
+	gid, stack := callerStack()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holders[lock] = append(s.holders[lock], &LockHolder{
+		Lock:      lock,
+		Write:     write,
+		Goroutine: gid,
+		Since:     time.Now(),
+		Stack:     stack,
+	})
+	s.held[gid] = append(s.held[gid], lock)
+}
+
+// debugUnlocked forgets a hold of lock, preferring one taken by the calling
+// goroutine since read locks may be released by another goroutine.
+func debugUnlocked(lock string, write bool) {
+	s := getLockDebug()
+	if s == nil {
+		return
+	}
+	buf := make([]byte, 64)
+	gid := goroutineID(buf[:runtime.Stack(buf, false)])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs := s.holders[lock]
+	idx := -1
+	for i, h := range hs {
+		if h.Write == write {
+			if idx < 0 || h.Goroutine == gid {
+				idx = i
+			}
+			if h.Goroutine == gid {
+				break
+			}
+		}
+	}
+	if idx < 0 {
+		// acquired before debugging was enabled
+		return
+	}
+	owner := hs[idx].Goroutine
+	if len(hs) == 1 {
+		delete(s.holders, lock)
+	} else {
+		s.holders[lock] = append(hs[:idx], hs[idx+1:]...)
+	}
+	held := s.held[owner]
+	for i := len(held) - 1; i >= 0; i-- {
+		if held[i] == lock {
+			held = append(held[:i], held[i+1:]...)
+			break
+		}
+	}
+	if len(held) == 0 {
+		delete(s.held, owner)
+	} else {
+		s.held[owner] = held
+	}
+}
+
+func (s *lockDebugState) watch() {
+	ticker := time.NewTicker(s.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			var reports []string
+			s.mu.Lock()
+			for _, hs := range s.holders {
+				for _, h := range hs {
+					if !h.reported && now.Sub(h.Since) > s.opts.HoldThreshold {
+						h.reported = true
+						reports = append(reports, fmt.Sprintf("lock %s held by goroutine %d for more than %v, acquired at:\n%s",
+							h.Lock, h.Goroutine, s.opts.HoldThreshold, h.Stack))
+					}
+				}
+			}
+			s.mu.Unlock()
+			for _, r := range reports {
+				s.opts.Report(r)
+			}
+		}
+	}
+}
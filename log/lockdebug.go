@@ -0,0 +1,21 @@
+package log
+
+import (
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+// EnableLockDebug turns on goutil lock debugging, logging locks held longer
+// than threshold and lock-order inversions as warnings.
+func EnableLockDebug(threshold time.Duration) {
+	goutil.EnableLockDebug(goutil.LockDebugOptions{
+		HoldThreshold: threshold,
+		Report:        LogWarn,
+	})
+}
+
+// LogLockHolders logs the current holders of debugged locks.
+func LogLockHolders(level int) {
+	DoLog(level, goutil.DumpLockHolders())
+}
@@ -1,123 +1,510 @@
 package goutil
 
 import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
 	"sync"
 )
 
-type MultiMutex struct {
-	Locks      map[string]*sync.RWMutex
-	LocksMutex sync.RWMutex
+// keyLock is the reader/writer lock of one key. It is guarded by the owning
+// shard's mutex and dropped from the map once nobody holds or waits on it.
+type keyLock struct {
+	refs    int // holders and waiters
+	readers int
+	writer  bool
+	waiters list.List // of *lockWaiter, in arrival order
 }
 
-func NewMultiMutex() *MultiMutex {
-	return &MultiMutex{
-		Locks: make(map[string]*sync.RWMutex),
+type lockWaiter struct {
+	write   bool
+	granted bool
+	ready   chan struct{}
+}
+
+func (l *keyLock) canGrant(write bool) bool {
+	if write {
+		return !l.writer && l.readers == 0
 	}
+	return !l.writer
 }
 
-func (m *MultiMutex) GetLock(k string) *sync.RWMutex {
-	// attempt rlocking read
-	m.LocksMutex.RLock()
-	lock, ok := m.Locks[k]
-	if ok {
-		m.LocksMutex.RUnlock()
-		return lock
+func (l *keyLock) grant(write bool) {
+	if write {
+		l.writer = true
+	} else {
+		l.readers++
 	}
-	m.LocksMutex.RUnlock()
+}
 
-	// write new lock if necessary
-	m.LocksMutex.Lock()
-	defer m.LocksMutex.Unlock()
-	lock, ok = m.Locks[k]
-	if !ok || lock == nil {
-		lock = &sync.RWMutex{}
-		m.Locks[k] = lock
+// wake grants the lock to waiters at the head of the queue, in order, until
+// one cannot be granted. Waiting writers therefore block later readers.
+func (l *keyLock) wake() {
+	for el := l.waiters.Front(); el != nil; el = l.waiters.Front() {
+		w := el.Value.(*lockWaiter)
+		if !l.canGrant(w.write) {
+			return
+		}
+		l.waiters.Remove(el)
+		l.grant(w.write)
+		w.granted = true
+		close(w.ready)
 	}
-	return lock
 }
 
-func (m *MultiMutex) Lock(k string) {
-	lock := m.GetLock(k)
-	lock.Lock()
+// keyedShard holds one lock per key, created on first use and deleted when
+// released by its last holder, so memory is bounded by the keys in use.
+type keyedShard[K comparable] struct {
+	mu    sync.Mutex
+	locks map[K]*keyLock
+	_     [48]byte // keep shards on separate cache lines
 }
 
-func (m *MultiMutex) Unlock(k string) {
-	lock := m.GetLock(k)
-	lock.Unlock()
+func (m *keyedShard[K]) get(k K) *keyLock {
+	if m.locks == nil {
+		m.locks = make(map[K]*keyLock)
+	}
+	l := m.locks[k]
+	if l == nil {
+		l = &keyLock{}
+		m.locks[k] = l
+	}
+	return l
 }
 
-func (m *MultiMutex) RLock(k string) {
-	lock := m.GetLock(k)
-	lock.RLock()
+func (m *keyedShard[K]) put(k K, l *keyLock) {
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, k)
+	}
 }
 
-func (m *MultiMutex) RUnlock(k string) {
-	lock := m.GetLock(k)
-	lock.RUnlock()
+// lock acquires k, waiting until ctx is done. A nil ctx waits forever.
+func (m *keyedShard[K]) lock(ctx context.Context, k K, write bool) error {
+	m.mu.Lock()
+	l := m.get(k)
+	l.refs++
+	if l.waiters.Len() == 0 && l.canGrant(write) {
+		l.grant(write)
+		m.mu.Unlock()
+		return nil
+	}
+	w := &lockWaiter{write: write, ready: make(chan struct{})}
+	el := l.waiters.PushBack(w)
+	m.mu.Unlock()
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-w.ready:
+		return nil
+	case <-done:
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w.granted {
+		// granted while giving up: hand the lock on
+		m.release(k, l, write)
+	} else {
+		l.waiters.Remove(el)
+		l.wake()
+		m.put(k, l)
+	}
+	return ctx.Err()
 }
 
-type MultiMutexUint32 struct {
-	Locks      map[uint32]*sync.Mutex
-	LocksMutex sync.RWMutex
+func (m *keyedShard[K]) tryLock(k K, write bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.get(k)
+	l.refs++
+	if l.waiters.Len() == 0 && l.canGrant(write) {
+		l.grant(write)
+		return true
+	}
+	m.put(k, l)
+	return false
 }
 
-func NewMultiMutexUint32() *MultiMutexUint32 {
-	return &MultiMutexUint32{
-		Locks: make(map[uint32]*sync.Mutex),
+func (m *keyedShard[K]) unlock(k K, write bool) {
+	if !m.tryUnlock(k, write) {
+		panic(fmt.Sprintf("goutil: unlock of unlocked key %v", k))
 	}
 }
 
-func (m *MultiMutexUint32) GetLock(k uint32) *sync.Mutex {
-	m.LocksMutex.Lock()
-	defer m.LocksMutex.Unlock()
-	lock := m.Locks[k]
-	if lock == nil {
-		lock = &sync.Mutex{}
-		m.Locks[k] = lock
+// tryUnlock releases k, reporting false if k was not held in that mode.
+func (m *keyedShard[K]) tryUnlock(k K, write bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.locks[k]
+	if l == nil || (write && !l.writer) || (!write && (l.writer || l.readers == 0)) {
+		return false
 	}
-	return lock
+	m.release(k, l, write)
+	return true
 }
 
-func (m *MultiMutexUint32) Lock(k uint32) {
-	lock := m.GetLock(k)
-	lock.Lock()
+// release must be called with m.mu held.
+func (m *keyedShard[K]) release(k K, l *keyLock, write bool) {
+	if write {
+		l.writer = false
+	} else {
+		l.readers--
+	}
+	l.wake()
+	m.put(k, l)
 }
 
-func (m *MultiMutexUint32) Unlock(k uint32) {
-	lock := m.GetLock(k)
-	lock.Unlock()
+func (m *keyedShard[K]) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.locks)
 }
 
-type MultiMutexUint64 struct {
-	Locks      map[uint64]*sync.Mutex
-	LocksMutex sync.RWMutex
+// KeyedMutex is a reader/writer lock per key. Per-key state only exists while
+// the key is held or waited on. Waiters are served in arrival order, so a
+// waiting writer is not starved by later readers. The zero value is an
+// unsharded KeyedMutex ready to use.
+type KeyedMutex[K comparable] struct {
+	single keyedShard[K]
+	shards []keyedShard[K]
+	hash   func(K) uint64
 }
 
-func NewMultiMutexUint64() *MultiMutexUint64 {
-	return &MultiMutexUint64{
-		Locks: make(map[uint64]*sync.Mutex),
+func NewKeyedMutex[K comparable]() *KeyedMutex[K] {
+	return &KeyedMutex[K]{}
+}
+
+// NewShardedKeyedMutex spreads keys over n independently locked maps to cut
+// contention between unrelated keys. A nil hash uses HashKey.
+func NewShardedKeyedMutex[K comparable](n int, hash func(K) uint64) *KeyedMutex[K] {
+	m := &KeyedMutex[K]{hash: hash}
+	if n > 1 {
+		m.shards = make([]keyedShard[K], n)
 	}
+	return m
 }
 
-func (m *MultiMutexUint64) GetLock(k uint64) *sync.Mutex {
-	m.LocksMutex.Lock()
-	defer m.LocksMutex.Unlock()
-	lock := m.Locks[k]
-	if lock == nil {
-		lock = &sync.Mutex{}
-		m.Locks[k] = lock
+func (m *KeyedMutex[K]) hashKey(k K) uint64 {
+	if m.hash != nil {
+		return m.hash(k)
+	}
+	return HashKey(k)
+}
+
+func (m *KeyedMutex[K]) shard(k K) *keyedShard[K] {
+	if len(m.shards) == 0 {
+		return &m.single
+	}
+	return &m.shards[m.hashKey(k)%uint64(len(m.shards))]
+}
+
+func (m *KeyedMutex[K]) debugName(k K) string {
+	return fmt.Sprintf("%T@%p[%v]", m, m, k)
+}
+
+func (m *KeyedMutex[K]) lock(ctx context.Context, k K, write bool) error {
+	if !LockDebugEnabled() {
+		return m.shard(k).lock(ctx, k, write)
+	}
+	name := m.debugName(k)
+	debugLockWait(name)
+	err := m.shard(k).lock(ctx, k, write)
+	if err == nil {
+		debugLocked(name, write)
+	}
+	return err
+}
+
+func (m *KeyedMutex[K]) tryLock(k K, write bool) bool {
+	ok := m.shard(k).tryLock(k, write)
+	if ok && LockDebugEnabled() {
+		debugLocked(m.debugName(k), write)
+	}
+	return ok
+}
+
+func (m *KeyedMutex[K]) unlock(k K, write bool) {
+	if LockDebugEnabled() {
+		debugUnlocked(m.debugName(k), write)
+	}
+	m.shard(k).unlock(k, write)
+}
+
+func (m *KeyedMutex[K]) Lock(k K) {
+	m.lock(nil, k, true)
+}
+
+func (m *KeyedMutex[K]) Unlock(k K) {
+	m.unlock(k, true)
+}
+
+func (m *KeyedMutex[K]) RLock(k K) {
+	m.lock(nil, k, false)
+}
+
+func (m *KeyedMutex[K]) RUnlock(k K) {
+	m.unlock(k, false)
+}
+
+// LockContext locks k, giving up with ctx.Err() once ctx is done.
+func (m *KeyedMutex[K]) LockContext(ctx context.Context, k K) error {
+	return m.lock(ctx, k, true)
+}
+
+// RLockContext read-locks k, giving up with ctx.Err() once ctx is done.
+func (m *KeyedMutex[K]) RLockContext(ctx context.Context, k K) error {
+	return m.lock(ctx, k, false)
+}
+
+// TryLock locks k only if it is free right away.
+func (m *KeyedMutex[K]) TryLock(k K) bool {
+	return m.tryLock(k, true)
+}
+
+// TryRLock read-locks k only if it can be shared right away.
+func (m *KeyedMutex[K]) TryRLock(k K) bool {
+	return m.tryLock(k, false)
+}
+
+// Len returns the number of keys currently held or waited on.
+func (m *KeyedMutex[K]) Len() int {
+	n := m.single.len()
+	for i := range m.shards {
+		n += m.shards[i].len()
+	}
+	return n
+}
+
+// SortKeys returns keys without duplicates in the order LockAll acquires them:
+// by hash, then by compareKeys for colliding hashes.
+func (m *KeyedMutex[K]) SortKeys(keys ...K) []K {
+	type hashed struct {
+		k K
+		h uint64
+	}
+	seen := make(map[K]bool, len(keys))
+	list := make([]hashed, 0, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			list = append(list, hashed{k, m.hashKey(k)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].h != list[j].h {
+			return list[i].h < list[j].h
+		}
+		return compareKeys(list[i].k, list[j].k) < 0
+	})
+	out := make([]K, len(list))
+	for i, h := range list {
+		out[i] = h.k
+	}
+	return out
+}
+
+// LockAll locks every key. Keys are acquired in a deterministic order, so
+// concurrent LockAll calls over overlapping keys cannot deadlock each other.
+func (m *KeyedMutex[K]) LockAll(keys ...K) {
+	for _, k := range m.SortKeys(keys...) {
+		m.Lock(k)
+	}
+}
+
+// LockAllContext is LockAll giving up once ctx is done, in which case no key
+// is left locked.
+func (m *KeyedMutex[K]) LockAllContext(ctx context.Context, keys ...K) error {
+	sorted := m.SortKeys(keys...)
+	for i, k := range sorted {
+		if err := m.LockContext(ctx, k); err != nil {
+			for _, held := range sorted[:i] {
+				m.Unlock(held)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// UnlockAll unlocks keys locked by LockAll.
+func (m *KeyedMutex[K]) UnlockAll(keys ...K) {
+	for _, k := range m.SortKeys(keys...) {
+		m.Unlock(k)
+	}
+}
+
+// HashKey is the default KeyedMutex hash: FNV-1a of strings and of the bytes
+// of integers, and for other types of their fields, with pointers and
+// channels hashed by address so that a key keeps its hash when what it points
+// to changes.
+func HashKey[K comparable](k K) uint64 {
+	h := fnv.New64a()
+	switch v := interface{}(k).(type) {
+	case string:
+		h.Write([]byte(v))
+	case int:
+		h.Write(Int64ToBytes(int64(v)))
+	case int64:
+		h.Write(Int64ToBytes(v))
+	case int32:
+		h.Write(Int64ToBytes(int64(v)))
+	case uint:
+		h.Write(UInt64ToBytes(uint64(v)))
+	case uint64:
+		h.Write(UInt64ToBytes(v))
+	case uint32:
+		h.Write(UInt64ToBytes(uint64(v)))
+	default:
+		hashValue(h, reflect.ValueOf(&k).Elem())
+	}
+	return h.Sum64()
+}
+
+// hashValue hashes v consistently with ==.
+func hashValue(h hash.Hash64, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		h.Write(Int64ToBytes(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		h.Write(UInt64ToBytes(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		h.Write(UInt64ToBytes(floatBits(v.Float())))
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		h.Write(UInt64ToBytes(floatBits(real(c))))
+		h.Write(UInt64ToBytes(floatBits(imag(c))))
+	case reflect.String:
+		h.Write(UInt64ToBytes(uint64(v.Len())))
+		h.Write([]byte(v.String()))
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		h.Write(UInt64ToBytes(uint64(v.Pointer())))
+	case reflect.Interface:
+		if v.IsNil() {
+			h.Write([]byte{0})
+			return
+		}
+		h.Write([]byte(v.Elem().Type().String()))
+		hashValue(h, v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i))
+		}
+	}
+}
+
+// floatBits returns the bits of f with -0 folded into 0, since they compare
+// equal.
+func floatBits(f float64) uint64 {
+	if f == 0 {
+		return 0
+	}
+	return math.Float64bits(f)
+}
+
+// compareKeys orders comparable keys consistently with ==, comparing
+// pointers and channels by address.
+func compareKeys[K comparable](a, b K) int {
+	return compareValues(reflect.ValueOf(&a).Elem(), reflect.ValueOf(&b).Elem())
+}
+
+func compareValues(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Bool:
+		return compareOrdered(boolInt(a.Bool()), boolInt(b.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return compareOrdered(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareOrdered(a.Float(), b.Float())
+	case reflect.Complex64, reflect.Complex128:
+		if c := compareOrdered(real(a.Complex()), real(b.Complex())); c != 0 {
+			return c
+		}
+		return compareOrdered(imag(a.Complex()), imag(b.Complex()))
+	case reflect.String:
+		return compareOrdered(a.String(), b.String())
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		return compareOrdered(a.Pointer(), b.Pointer())
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return compareOrdered(boolInt(!a.IsNil()), boolInt(!b.IsNil()))
+		}
+		a, b = a.Elem(), b.Elem()
+		if a.Type() != b.Type() {
+			return compareOrdered(a.Type().String(), b.Type().String())
+		}
+		return compareValues(a, b)
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if c := compareValues(a.Index(i), b.Index(i)); c != 0 {
+				return c
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if c := compareValues(a.Field(i), b.Field(i)); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+func compareOrdered[T int | int64 | uint64 | uintptr | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
-	return lock
+	return 0
 }
 
-func (m *MultiMutexUint64) Lock(k uint64) {
-	lock := m.GetLock(k)
-	lock.Lock()
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-func (m *MultiMutexUint64) Unlock(k uint64) {
-	lock := m.GetLock(k)
-	lock.Unlock()
+// MultiMutex, MultiMutexUint32 and MultiMutexUint64 predate KeyedMutex and are
+// kept as names for its instantiations.
+type MultiMutex = KeyedMutex[string]
+
+type MultiMutexUint32 = KeyedMutex[uint32]
+
+type MultiMutexUint64 = KeyedMutex[uint64]
+
+func NewMultiMutex() *MultiMutex {
+	return NewKeyedMutex[string]()
+}
+
+func NewMultiMutexUint32() *MultiMutexUint32 {
+	return NewKeyedMutex[uint32]()
+}
+
+func NewMultiMutexUint64() *MultiMutexUint64 {
+	return NewKeyedMutex[uint64]()
 }
 
 type OptionalMode bool
@@ -174,10 +561,18 @@ func NewDisabledOptionalRWMutex() *OptionalRWMutex {
 	return nil
 }
 
+func (lock *OptionalRWMutex) debugName() string {
+	return fmt.Sprintf("OptionalRWMutex@%p", lock)
+}
+
 func (lock *OptionalRWMutex) Lock() {
 	if lock == nil {
 		return
 	}
+	if LockDebugEnabled() {
+		debugLockWait(lock.debugName())
+		defer debugLocked(lock.debugName(), true)
+	}
 	lock.RWMutex.Lock()
 }
 
@@ -185,6 +580,9 @@ func (lock *OptionalRWMutex) Unlock() {
 	if lock == nil {
 		return
 	}
+	if LockDebugEnabled() {
+		debugUnlocked(lock.debugName(), true)
+	}
 	lock.RWMutex.Unlock()
 }
 
@@ -192,12 +590,44 @@ func (lock *OptionalRWMutex) RLock() {
 	if lock == nil {
 		return
 	}
+	if LockDebugEnabled() {
+		debugLockWait(lock.debugName())
+		defer debugLocked(lock.debugName(), false)
+	}
 	lock.RWMutex.RLock()
 }
 
+// TryLock tries to lock lock and reports whether it succeeded. A disabled
+// (nil) lock always succeeds.
+func (lock *OptionalRWMutex) TryLock() bool {
+	if lock == nil {
+		return true
+	}
+	ok := lock.RWMutex.TryLock()
+	if ok && LockDebugEnabled() {
+		debugLocked(lock.debugName(), true)
+	}
+	return ok
+}
+
+// TryRLock is TryLock for a read lock.
+func (lock *OptionalRWMutex) TryRLock() bool {
+	if lock == nil {
+		return true
+	}
+	ok := lock.RWMutex.TryRLock()
+	if ok && LockDebugEnabled() {
+		debugLocked(lock.debugName(), false)
+	}
+	return ok
+}
+
 func (lock *OptionalRWMutex) RUnlock() {
 	if lock == nil {
 		return
 	}
+	if LockDebugEnabled() {
+		debugUnlocked(lock.debugName(), false)
+	}
 	lock.RWMutex.RUnlock()
 }
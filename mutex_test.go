@@ -0,0 +1,291 @@
+package goutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiMutexReleasesKeys(t *testing.T) {
+	m := NewMultiMutex()
+	var wg sync.WaitGroup
+	counts := make([]int, 10)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprint(i % 10)
+				if i%3 == 0 {
+					m.RLock(k)
+					_ = counts[i%10]
+					m.RUnlock(k)
+					continue
+				}
+				m.Lock(k)
+				counts[i%10]++
+				m.Unlock(k)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := m.Len(); n != 0 {
+		t.Errorf("%d keys left after all locks were released", n)
+	}
+}
+
+func TestMultiMutexLockContext(t *testing.T) {
+	m := NewMultiMutexUint64()
+	m.Lock(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.LockContext(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("LockContext on held key returned %v", err)
+	}
+	if m.TryLock(1) {
+		t.Fatal("TryLock succeeded on held key")
+	}
+	if !m.TryLock(2) {
+		t.Fatal("TryLock failed on free key")
+	}
+	m.Unlock(2)
+	m.Unlock(1)
+	if n := m.Len(); n != 0 {
+		t.Errorf("%d keys left after cancelled wait", n)
+	}
+}
+
+func TestMultiMutexWriterPreference(t *testing.T) {
+	m := NewMultiMutex()
+	m.RLock("k")
+	locked := make(chan struct{})
+	go func() {
+		m.Lock("k")
+		close(locked)
+	}()
+	for m.TryRLock("k") {
+		// the writer is not queued yet
+		m.RUnlock("k")
+		time.Sleep(time.Millisecond)
+	}
+	m.RUnlock("k")
+	<-locked
+	m.Unlock("k")
+}
+
+func TestKeyedMutexLockAll(t *testing.T) {
+	m := NewShardedKeyedMutex[int](4, nil)
+	var wg sync.WaitGroup
+	total := 0
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				// overlapping key sets given in different orders
+				keys := []int{g % 3, (g + 1) % 3, 7, g % 3}
+				if g%2 == 0 {
+					keys = []int{7, (g + 1) % 3, g % 3}
+				}
+				m.LockAll(keys...)
+				total++
+				m.UnlockAll(keys...)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if total != 8*200 {
+		t.Errorf("total = %d, want %d", total, 8*200)
+	}
+	if n := m.Len(); n != 0 {
+		t.Errorf("%d keys left locked", n)
+	}
+
+	m.Lock(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.LockAllContext(ctx, 1, 2, 3); err == nil {
+		t.Fatal("LockAllContext succeeded with a key held")
+	}
+	m.Unlock(2)
+	if n := m.Len(); n != 0 {
+		t.Errorf("%d keys left locked after failed LockAllContext", n)
+	}
+}
+
+func TestKeyedMutexPointerKeys(t *testing.T) {
+	type value struct{ n int }
+	m := NewShardedKeyedMutex[*value](16, nil)
+	p := &value{7}
+	m.Lock(p)
+	p.n = 8 // must not move p to another shard
+	m.Unlock(p)
+
+	a, b := &value{1}, &value{1}
+	if HashKey(a) == HashKey(b) {
+		t.Error("distinct pointers with equal contents hash alike")
+	}
+	// a colliding hash leaves the order to the tie-break
+	same := NewShardedKeyedMutex[*value](16, func(*value) uint64 { return 0 })
+	ab, ba := same.SortKeys(a, b), same.SortKeys(b, a)
+	if len(ab) != 2 || ab[0] != ba[0] || ab[1] != ba[1] {
+		t.Fatalf("SortKeys order depends on the argument order: %v, %v", ab, ba)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			keys := []*value{a, b}
+			if g%2 == 1 {
+				keys = []*value{b, a}
+			}
+			for i := 0; i < 200; i++ {
+				same.LockAll(keys...)
+				same.UnlockAll(keys...)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	type pair struct {
+		p *value
+		s string
+	}
+	if HashKey(pair{a, "x"}) == HashKey(pair{b, "x"}) || compareKeys(pair{a, "x"}, pair{b, "x"}) == 0 ||
+		HashKey(pair{a, "x"}) != HashKey(pair{a, "x"}) || compareKeys(pair{a, "x"}, pair{a, "x"}) != 0 {
+		t.Error("struct keys with pointers are not compared by identity")
+	}
+}
+
+func TestLockDebug(t *testing.T) {
+	var mu sync.Mutex
+	var reports []string
+	EnableLockDebug(LockDebugOptions{
+		HoldThreshold: 5 * time.Millisecond,
+		Report: func(v ...interface{}) {
+			mu.Lock()
+			reports = append(reports, fmt.Sprint(v...))
+			mu.Unlock()
+		},
+	})
+	defer DisableLockDebug()
+
+	m := NewMultiMutex()
+	m.Lock("a")
+	m.Lock("b")
+	m.Unlock("b")
+	m.Unlock("a")
+	m.Lock("b")
+	m.Lock("a")
+	if n := len(LockHolders()); n != 2 {
+		t.Errorf("%d holders recorded, want 2", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	m.Unlock("a")
+	m.Unlock("b")
+	if n := len(LockHolders()); n != 0 {
+		t.Errorf("%d holders left after unlocking", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var inversions, holds int
+	for _, r := range reports {
+		switch {
+		case strings.HasPrefix(r, "lock order inversion"):
+			inversions++
+		case strings.Contains(r, "held by goroutine"):
+			holds++
+		}
+	}
+	if inversions != 1 || holds != 2 {
+		t.Errorf("got %d inversion and %d long hold reports, want 1 and 2:\n%s", inversions, holds, strings.Join(reports, "\n"))
+	}
+}
+
+func TestTimeoutRWMutex(t *testing.T) {
+	m := NewTimeoutRWMutex(10 * time.Millisecond)
+	if err := m.Unlock(); err != ErrNotLocked {
+		t.Fatalf("Unlock of free mutex returned %v", err)
+	}
+	if err := m.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lock(); err != context.DeadlineExceeded {
+		t.Fatalf("Lock while read-locked returned %v", err)
+	}
+	if !m.TryRLock() {
+		t.Fatal("TryRLock failed with only readers")
+	}
+	m.RUnlock()
+	m.RUnlock()
+	if err := m.RUnlock(); err != ErrNotLocked {
+		t.Fatalf("extra RUnlock returned %v", err)
+	}
+	if err := m.LockContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.TryRLock() {
+		t.Fatal("TryRLock succeeded while write-locked")
+	}
+	if err := m.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockWithTimeout(t *testing.T) {
+	var mu sync.RWMutex
+	mu.Lock()
+	if err := LockWithTimeout(&mu, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("LockWithTimeout on held mutex returned %v", err)
+	}
+	if err := RLockWithTimeout(&mu, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("RLockWithTimeout on held mutex returned %v", err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		mu.Unlock()
+	}()
+	if err := LockWithTimeout(&mu, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Unlock()
+	// the abandoned waiters release their locks once they get them
+	if err := LockWithTimeout(&mu, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Unlock()
+
+	var disabled *OptionalRWMutex
+	if err := LockWithTimeout(disabled, time.Millisecond); err != nil {
+		t.Fatalf("LockWithTimeout on a disabled OptionalRWMutex returned %v", err)
+	}
+	if err := RLockWithTimeout(disabled, time.Millisecond); err != nil {
+		t.Fatalf("RLockWithTimeout on a disabled OptionalRWMutex returned %v", err)
+	}
+
+	EnableLockDebug(LockDebugOptions{Report: func(...interface{}) {}})
+	defer DisableLockDebug()
+	opt := NewOptionalRWMutex(true)
+	if err := RLockWithTimeout(opt, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if h := LockHolders(); len(h) != 1 || h[0].Write {
+		t.Errorf("holders after RLockWithTimeout = %+v, want one reader", h)
+	}
+	opt.RUnlock()
+	if err := LockWithTimeout(opt, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if h := LockHolders(); len(h) != 1 || !h[0].Write {
+		t.Errorf("holders after LockWithTimeout = %+v, want one writer", h)
+	}
+	opt.Unlock()
+	if h := LockHolders(); len(h) != 0 {
+		t.Errorf("%d holders left after unlocking", len(h))
+	}
+}
@@ -0,0 +1,353 @@
+package goutil
+
+import (
+	"sync"
+	"time"
+)
+
+// Ordered is satisfied by types supporting <.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+const skipListMaxLevel = 32
+
+type skipLink[T Ordered] struct {
+	node *skipNode[T]
+	// number of items from this node to node, or to the end of the list if
+	// node is nil
+	span int
+}
+
+type skipNode[T Ordered] struct {
+	item T
+	next []skipLink[T]
+}
+
+// OrderedSet is a thread-safe sorted set, kept in an indexable skip list so
+// that lookups, inserts, removals and rank/select queries take O(log n). The
+// zero value is an empty set ready to use.
+type OrderedSet[T Ordered] struct {
+	head  *skipNode[T]
+	level int
+	len   int
+	rnd   uint64
+	sync.RWMutex
+}
+
+type OrderedUint64Set = OrderedSet[uint64]
+
+type OrderedStringSet = OrderedSet[string]
+
+func NewOrderedSet[T Ordered](items ...T) *OrderedSet[T] {
+	s := &OrderedSet[T]{}
+	s.AddAll(items...)
+	return s
+}
+
+func NewOrderedUint64Set() *OrderedUint64Set {
+	return &OrderedUint64Set{}
+}
+
+func NewOrderedStringSet() *OrderedStringSet {
+	return &OrderedStringSet{}
+}
+
+// init must be called with the write lock held.
+func (s *OrderedSet[T]) init() {
+	if s.head == nil {
+		s.head = &skipNode[T]{next: make([]skipLink[T], skipListMaxLevel)}
+		s.level = 1
+		s.rnd = uint64(time.Now().UnixNano()) | 1
+	}
+}
+
+// randomLevel returns a level with P(level > k) = 4^-k.
+func (s *OrderedSet[T]) randomLevel() int {
+	// xorshift64
+	s.rnd ^= s.rnd << 13
+	s.rnd ^= s.rnd >> 7
+	s.rnd ^= s.rnd << 17
+	level := 1
+	for r := s.rnd; level < skipListMaxLevel && r&3 == 0; r >>= 2 {
+		level++
+	}
+	return level
+}
+
+// Add inserts item, reporting whether it was not in the set yet.
+func (s *OrderedSet[T]) Add(item T) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.add(item)
+}
+
+// AddAll inserts all items under a single lock.
+func (s *OrderedSet[T]) AddAll(items ...T) {
+	s.Lock()
+	defer s.Unlock()
+	for _, item := range items {
+		s.add(item)
+	}
+}
+
+func (s *OrderedSet[T]) add(item T) bool {
+	s.init()
+	var update [skipListMaxLevel]*skipNode[T]
+	var rank [skipListMaxLevel]int
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		if i < s.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.next[i].node != nil && x.next[i].node.item < item {
+			rank[i] += x.next[i].span
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+	if n := x.next[0].node; n != nil && n.item == item {
+		return false
+	}
+	level := s.randomLevel()
+	for i := s.level; i < level; i++ {
+		update[i] = s.head
+		s.head.next[i].span = s.len
+	}
+	if level > s.level {
+		s.level = level
+	}
+	n := &skipNode[T]{item: item, next: make([]skipLink[T], level)}
+	for i := 0; i < level; i++ {
+		prev := &update[i].next[i]
+		n.next[i] = skipLink[T]{node: prev.node, span: prev.span - (rank[0] - rank[i])}
+		*prev = skipLink[T]{node: n, span: rank[0] - rank[i] + 1}
+	}
+	for i := level; i < s.level; i++ {
+		update[i].next[i].span++
+	}
+	s.len++
+	return true
+}
+
+// Remove deletes item, reporting whether it was in the set.
+func (s *OrderedSet[T]) Remove(item T) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.head == nil {
+		return false
+	}
+	var update [skipListMaxLevel]*skipNode[T]
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.item < item {
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+	x = x.next[0].node
+	if x == nil || x.item != item {
+		return false
+	}
+	for i := 0; i < s.level; i++ {
+		prev := &update[i].next[i]
+		if prev.node == x {
+			prev.span += x.next[i].span - 1
+			prev.node = x.next[i].node
+		} else {
+			prev.span--
+		}
+	}
+	for s.level > 1 && s.head.next[s.level-1].node == nil {
+		s.level--
+	}
+	s.len--
+	return true
+}
+
+func (s *OrderedSet[T]) Has(item T) bool {
+	s.RLock()
+	defer s.RUnlock()
+	n := s.ceiling(item)
+	return n != nil && n.item == item
+}
+
+// Len returns the number of items in a set.
+func (s *OrderedSet[T]) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.len
+}
+
+func (s *OrderedSet[T]) IsEmpty() bool {
+	return s.Len() == 0
+}
+
+// Clear removes all items from the set
+func (s *OrderedSet[T]) Clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.head = nil
+	s.len = 0
+}
+
+// ceiling returns the first node not less than item, or nil.
+func (s *OrderedSet[T]) ceiling(item T) *skipNode[T] {
+	if s.head == nil {
+		return nil
+	}
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.item < item {
+			x = x.next[i].node
+		}
+	}
+	return x.next[0].node
+}
+
+// floor returns the last node not greater than item, or nil.
+func (s *OrderedSet[T]) floor(item T) *skipNode[T] {
+	if s.head == nil {
+		return nil
+	}
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.item <= item {
+			x = x.next[i].node
+		}
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+func found[T Ordered](n *skipNode[T]) (T, bool) {
+	if n == nil {
+		var zero T
+		return zero, false
+	}
+	return n.item, true
+}
+
+func (s *OrderedSet[T]) Min() (T, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.head == nil {
+		return found[T](nil)
+	}
+	return found(s.head.next[0].node)
+}
+
+func (s *OrderedSet[T]) Max() (T, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.head == nil {
+		return found[T](nil)
+	}
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil {
+			x = x.next[i].node
+		}
+	}
+	if x == s.head {
+		return found[T](nil)
+	}
+	return x.item, true
+}
+
+// Floor returns the greatest item not greater than item.
+func (s *OrderedSet[T]) Floor(item T) (T, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return found(s.floor(item))
+}
+
+// Ceiling returns the least item not less than item.
+func (s *OrderedSet[T]) Ceiling(item T) (T, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return found(s.ceiling(item))
+}
+
+// Rank returns the number of items less than item, which is the index item
+// has or would have in List.
+func (s *OrderedSet[T]) Rank(item T) int {
+	s.RLock()
+	defer s.RUnlock()
+	if s.head == nil {
+		return 0
+	}
+	rank := 0
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.item < item {
+			rank += x.next[i].span
+			x = x.next[i].node
+		}
+	}
+	return rank
+}
+
+// Select returns the item at index i in sorted order.
+func (s *OrderedSet[T]) Select(i int) (T, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.head == nil || i < 0 || i >= s.len {
+		return found[T](nil)
+	}
+	target := i + 1
+	traversed := 0
+	x := s.head
+	for l := s.level - 1; l >= 0; l-- {
+		for x.next[l].node != nil && traversed+x.next[l].span <= target {
+			traversed += x.next[l].span
+			x = x.next[l].node
+		}
+		if traversed == target {
+			return x.item, true
+		}
+	}
+	return found[T](nil)
+}
+
+// Range calls f in ascending order for the items between lo and hi
+// inclusive, until f returns false. The set is read-locked meanwhile, so f
+// must not modify it.
+func (s *OrderedSet[T]) Range(lo, hi T, f func(item T) bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for n := s.ceiling(lo); n != nil && n.item <= hi; n = n.next[0].node {
+		if !f(n.item) {
+			return
+		}
+	}
+}
+
+// Ascend calls f for every item in ascending order until f returns false,
+// under the same restriction as Range.
+func (s *OrderedSet[T]) Ascend(f func(item T) bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.head == nil {
+		return
+	}
+	for n := s.head.next[0].node; n != nil; n = n.next[0].node {
+		if !f(n.item) {
+			return
+		}
+	}
+}
+
+// List returns all items in ascending order.
+func (s *OrderedSet[T]) List() []T {
+	list := make([]T, 0, s.Len())
+	s.Ascend(func(item T) bool {
+		list = append(list, item)
+		return true
+	})
+	return list
+}
@@ -0,0 +1,207 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	util "github.com/alexi/goutil"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// Maximum pending writes used when loading a backup.
+const restorePendingWrites = 256
+
+// Maximum length of a single JSON-lines record accepted by Import.
+const maxImportLine = 64 << 20
+
+// Record is one line of the JSON-lines export format. Value holds the decoded
+// value as JSON; Raw holds the stored bytes as-is, along with their schema
+// Version, for exports made without knowing the value type.
+type Record struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Raw     []byte          `json:"raw,omitempty"`
+	Version int             `json:"version,omitempty"`
+}
+
+// Backup writes a full badger backup of the store key to w. The store must not
+// be in use by another process.
+func Backup(key string, w io.Writer) error {
+	db, err := getdb(key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Backup(w, 0)
+	return err
+}
+
+// Restore loads a backup produced by Backup into the store key. Keys already in
+// the store and absent from the backup are kept.
+func Restore(key string, r io.Reader) error {
+	db, err := getdb(key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = db.Load(r, restorePendingWrites); err != nil {
+		return err
+	}
+	invalidateWatchers(key)
+	return nil
+}
+
+// ExportRaw writes every entry of the store key to w as JSON lines, keeping the
+// values in their stored encoding.
+func ExportRaw(key string, w io.Writer) error {
+	db, err := getdb(key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	enc := json.NewEncoder(w)
+	return eachItem(db, func(item *badger.Item) error {
+		raw, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(Record{Key: string(item.Key()), Raw: raw, Version: int(item.UserMeta())})
+	})
+}
+
+// ImportRaw writes records read from r into the store key. Only records carrying
+// Raw bytes can be imported without a type instance; others are rejected.
+func ImportRaw(key string, r io.Reader) error {
+	return importRecords(key, r, func(rec *Record) ([]byte, byte, error) {
+		return rec.rawValue()
+	})
+}
+
+// rawValue returns the stored bytes and schema version of a raw record.
+func (rec *Record) rawValue() ([]byte, byte, error) {
+	if rec.Raw == nil {
+		return nil, 0, fmt.Errorf("record %q has no raw value", rec.Key)
+	}
+	if rec.Version < 0 || rec.Version > MaxVersion {
+		return nil, 0, fmt.Errorf("record %q has version %d out of range [0, %d]", rec.Key, rec.Version, MaxVersion)
+	}
+	return rec.Raw, byte(rec.Version), nil
+}
+
+func (m *PersistentStringMap) Backup(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Backup(m.key, w)
+}
+
+func (m *PersistentStringMap) Restore(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.cache.purge()
+	return Restore(m.key, r)
+}
+
+// Export writes every entry to w as JSON lines, decoding values with the map's
+// type instance.
+func (m *PersistentStringMap) Export(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	db, err := getdb(m.key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	enc := json.NewEncoder(w)
+	return eachItem(db, func(item *badger.Item) error {
+		var b []byte
+		if err := item.Value(func(val []byte) error {
+			v, err := m.decode(val, item.UserMeta())
+			if err != nil {
+				return err
+			}
+			b, err = json.Marshal(v)
+			return err
+		}); err != nil {
+			return fmt.Errorf("export %q: %v", item.Key(), err)
+		}
+		return enc.Encode(Record{Key: string(item.Key()), Value: b})
+	})
+}
+
+// Import writes records read from r, as produced by Export or ExportRaw. JSON
+// values are decoded into the map's type and re-encoded at the current version;
+// raw values are stored unchanged with their recorded version.
+func (m *PersistentStringMap) Import(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.cache.purge()
+	return importRecords(m.key, r, func(rec *Record) ([]byte, byte, error) {
+		if rec.Value == nil {
+			return rec.rawValue()
+		}
+		v := m.newInstance()
+		if err := json.Unmarshal(rec.Value, v); err != nil {
+			return nil, 0, fmt.Errorf("import %q: %v", rec.Key, err)
+		}
+		return m.marshal(v), m.version, nil
+	})
+}
+
+func (m *PersistentStringMap) newInstance() interface{} {
+	if encoder, ok := m.objectTypeInstance.(MarshalUnmarshaller); ok {
+		return encoder.Copy()
+	}
+	return util.Pointer_NewOfType(m.objectTypeInstance)
+}
+
+func eachItem(db *badger.DB, f func(item *badger.Item) error) error {
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := f(it.Item()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func importRecords(key string, r io.Reader, encode func(rec *Record) ([]byte, byte, error)) error {
+	db, err := getdb(key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return err
+		}
+		b, version, err := encode(&rec)
+		if err != nil {
+			return err
+		}
+		if err = wb.SetEntry(badger.NewEntry([]byte(rec.Key), b).WithMeta(version)); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = wb.Flush(); err != nil {
+		return err
+	}
+	invalidateWatchers(key)
+	return nil
+}
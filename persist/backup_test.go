@@ -0,0 +1,122 @@
+package persist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func writeTestValues(m *PersistentStringMap) map[string]testValue {
+	want := map[string]testValue{
+		"a": {Name: "a", Count: 1},
+		"b": {Name: "b", Count: 2},
+	}
+	for k, v := range want {
+		m.Write(k, v)
+	}
+	return want
+}
+
+func checkTestValues(t *testing.T, m *PersistentStringMap, want map[string]testValue) {
+	t.Helper()
+	for k, v := range want {
+		if got, ok := m.ReadOk(k); !ok || got != v {
+			t.Errorf("%s = %v, %v, want %v", k, got, ok, v)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	chdirTemp(t)
+	want := writeTestValues(NewPersistentStringMap("src", testValue{}))
+
+	var buf bytes.Buffer
+	if err := Backup("src", &buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewCachedPersistentStringMap("dst", testValue{}, CacheOptions{MaxEntries: 10})
+	dst.Write("a", testValue{Name: "stale"})
+	dst.Write("c", testValue{Name: "c"})
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	checkTestValues(t, dst, want)
+	if _, ok := dst.ReadOk("c"); !ok {
+		t.Error("Restore dropped a key missing from the backup")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	chdirTemp(t)
+	src := NewPersistentStringMap("src", testValue{})
+	want := writeTestValues(src)
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"value":{"Name":"a","Count":1}`) {
+		t.Fatalf("export is not decoded JSON:\n%s", buf.String())
+	}
+	dst := NewPersistentStringMap("dst", testValue{})
+	dst.SetVersion(2)
+	if err := dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	checkTestValues(t, dst, want)
+}
+
+func TestExportImportRaw(t *testing.T) {
+	chdirTemp(t)
+	src := NewPersistentStringMap("src", testValue{})
+	src.SetVersion(3)
+	want := writeTestValues(src)
+
+	var raw bytes.Buffer
+	if err := ExportRaw("src", &raw); err != nil {
+		t.Fatal(err)
+	}
+	exported := raw.String()
+	if err := ImportRaw("dst", strings.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewPersistentStringMap("dst", testValue{})
+	if _, err := dst.decode(nil, 3); err != ErrNewerVersion {
+		t.Fatalf("decode at a newer version = %v", err)
+	}
+	dst.SetVersion(3)
+	checkTestValues(t, dst, want)
+
+	// raw records go through a typed import unchanged
+	typed := NewPersistentStringMap("typed", testValue{})
+	typed.SetVersion(3)
+	if err := typed.Import(strings.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+	checkTestValues(t, typed, want)
+}
+
+func TestImportRejectsBadRecords(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("bad", testValue{})
+	for _, line := range []string{
+		`{"key":"a"}`,
+		`{"key":"a","raw":"AA==","version":256}`,
+		`{"key":"a","raw":"AA==","version":-1}`,
+	} {
+		if err := ImportRaw("bad", strings.NewReader(line)); err == nil {
+			t.Errorf("ImportRaw accepted %s", line)
+		}
+	}
+	for _, line := range []string{
+		`{"key":"a"}`,
+		`{"key":"a","raw":"AA==","version":300}`,
+	} {
+		if err := m.Import(strings.NewReader(line)); err == nil {
+			t.Errorf("Import accepted %s", line)
+		}
+	}
+	if _, ok := m.ReadOk("a"); ok {
+		t.Error("rejected record was stored")
+	}
+}
@@ -0,0 +1,153 @@
+package persist
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	util "github.com/alexi/goutil"
+)
+
+// CacheOptions bounds the in-memory cache kept in front of a PersistentStringMap.
+// A zero field leaves that dimension unbounded; MaxBytes is measured with
+// goutil.GetValueSize estimates of the decoded values.
+type CacheOptions struct {
+	MaxEntries int
+	MaxBytes   int64
+}
+
+func (o CacheOptions) enabled() bool {
+	return o.MaxEntries > 0 || o.MaxBytes > 0
+}
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type cacheEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// valueCache is an LRU of decoded values. A nil *valueCache is a disabled cache
+// and every method is a no-op on it.
+type valueCache struct {
+	opts      CacheOptions
+	mu        sync.Mutex
+	ll        *list.List
+	items     map[string]*list.Element
+	bytes     int64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newValueCache(opts CacheOptions) *valueCache {
+	if !opts.enabled() {
+		return nil
+	}
+	return &valueCache{
+		opts:  opts,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(k string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *valueCache) set(k string, v interface{}) {
+	if c == nil {
+		return
+	}
+	var size int64
+	if c.opts.MaxBytes > 0 {
+		size = util.GetValueSize(v)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		c.removeElement(el)
+	}
+	if c.opts.MaxBytes > 0 && size > c.opts.MaxBytes {
+		// would evict everything and still not fit
+		return
+	}
+	c.items[k] = c.ll.PushFront(&cacheEntry{key: k, value: v, size: size})
+	c.bytes += size
+	for c.overLimit() {
+		c.removeElement(c.ll.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+func (c *valueCache) remove(k string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+	}
+}
+
+func (c *valueCache) overLimit() bool {
+	if c.ll.Len() == 0 {
+		return false
+	}
+	if c.opts.MaxEntries > 0 && c.ll.Len() > c.opts.MaxEntries {
+		return true
+	}
+	return c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
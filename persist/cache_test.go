@@ -0,0 +1,125 @@
+package persist
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	util "github.com/alexi/goutil"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+}
+
+// chdirTemp runs the test inside a fresh directory, since stores live under
+// the relative path .store.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	chdirTemp(t)
+	m := NewCachedPersistentStringMap("cache", testValue{}, CacheOptions{MaxEntries: 10})
+	m.Write("a", testValue{Name: "a", Count: 1})
+	m.PurgeCache()
+
+	if v := m.Read("a"); v != (testValue{Name: "a", Count: 1}) {
+		t.Fatalf("Read = %v", v)
+	}
+	if v, ok := m.ReadOk("a"); !ok || v != (testValue{Name: "a", Count: 1}) {
+		t.Fatalf("ReadOk = %v, %v", v, ok)
+	}
+	if _, ok := m.ReadOk("missing"); ok {
+		t.Fatal("ReadOk found a missing key")
+	}
+	st := m.CacheStats()
+	if st.Hits != 1 || st.Misses != 2 || st.Entries != 1 {
+		t.Fatalf("stats = %+v, want 1 hit, 2 misses, 1 entry", st)
+	}
+
+	m.PurgeCache()
+	if st := m.CacheStats(); st.Entries != 0 || st.Bytes != 0 {
+		t.Fatalf("stats after purge = %+v", st)
+	}
+	if v := m.Read("a"); v != (testValue{Name: "a", Count: 1}) {
+		t.Fatalf("Read after purge = %v", v)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	chdirTemp(t)
+	m := NewCachedPersistentStringMap("entries", testValue{}, CacheOptions{MaxEntries: 2})
+	m.Write("a", testValue{Name: "a"})
+	m.Write("b", testValue{Name: "b"})
+	m.Read("a") // b is now least recently used
+	m.Write("c", testValue{Name: "c"})
+	st := m.CacheStats()
+	if st.Entries != 2 || st.Evictions != 1 {
+		t.Fatalf("stats = %+v, want 2 entries, 1 eviction", st)
+	}
+	hits := st.Hits
+	m.Read("a")
+	m.Read("c")
+	if st = m.CacheStats(); st.Hits != hits+2 {
+		t.Fatalf("a and c should be cached, stats = %+v", st)
+	}
+	m.Read("b")
+	if st = m.CacheStats(); st.Hits != hits+2 {
+		t.Fatalf("b should have been evicted, stats = %+v", st)
+	}
+
+	size := util.GetValueSize(testValue{Name: "x"})
+	m = NewCachedPersistentStringMap("bytes", testValue{}, CacheOptions{MaxBytes: 2 * size})
+	m.Write("a", testValue{Name: "a"})
+	m.Write("b", testValue{Name: "b"})
+	m.Write("c", testValue{Name: "c"})
+	if st = m.CacheStats(); st.Entries != 2 || st.Evictions != 1 || st.Bytes > 2*size {
+		t.Fatalf("stats = %+v, want 2 entries within %d bytes", st, 2*size)
+	}
+
+	big := testValue{Name: strings.Repeat("x", 1024)}
+	m.Write("big", big)
+	st = m.CacheStats()
+	if st.Entries != 2 || st.Evictions != 1 {
+		t.Fatalf("oversized value should be skipped, stats = %+v", st)
+	}
+	if v := m.Read("big"); v != big {
+		t.Fatal("oversized value was not stored")
+	}
+}
+
+func TestCacheWriteThrough(t *testing.T) {
+	chdirTemp(t)
+	m := NewCachedPersistentStringMap("through", testValue{}, CacheOptions{MaxEntries: 10})
+	other := NewPersistentStringMap("through", testValue{})
+
+	m.Write("a", testValue{Name: "a", Count: 1})
+	if v := other.Read("a"); v != (testValue{Name: "a", Count: 1}) {
+		t.Fatalf("store holds %v", v)
+	}
+	m.Write("a", testValue{Name: "a", Count: 2})
+	if v := m.Read("a"); v != (testValue{Name: "a", Count: 2}) {
+		t.Fatalf("Read after overwrite = %v", v)
+	}
+	if st := m.CacheStats(); st.Hits != 1 || st.Misses != 0 {
+		t.Fatalf("Write should populate the cache, stats = %+v", st)
+	}
+
+	m.Delete("a")
+	if _, ok := other.ReadOk("a"); ok {
+		t.Fatal("Delete did not reach the store")
+	}
+	if _, ok := m.ReadOk("a"); ok {
+		t.Fatal("Delete left the value cached")
+	}
+}
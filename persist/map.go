@@ -31,6 +31,12 @@ type PersistentStringMap struct {
 	key                string
 	mu                 sync.RWMutex
 	objectTypeInstance interface{}
+	cache              *valueCache
+	// schemaMu guards version and migrations for decoding, which also runs
+	// for watchers while writes through other maps hold their own mu.
+	schemaMu   sync.RWMutex
+	version    byte
+	migrations map[int]MigrationFunc
 }
 
 // func getReflectValue(value interface{}) (bool, reflect.Value) {
@@ -77,6 +83,18 @@ func (m *PersistentStringMap) unmarshal(b []byte) (interface{}, error) {
 	return r.Interface(), err
 }
 
+func (m *PersistentStringMap) marshal(v interface{}) []byte {
+	if encoder, ok := v.(MarshalUnmarshaller); ok {
+		b, _ := encoder.Marshal()
+		return b
+	}
+	b, err := util.GetBytes(v)
+	if err != nil {
+		log.LogError("get-bytes error:", err)
+	}
+	return b
+}
+
 func NewPersistentStringMap(key string, otype interface{}) *PersistentStringMap {
 	m := &PersistentStringMap{
 		key:                key,
@@ -85,6 +103,38 @@ func NewPersistentStringMap(key string, otype interface{}) *PersistentStringMap
 	return m
 }
 
+// NewCachedPersistentStringMap returns a map that keeps recently used decoded
+// values in memory. Writes and deletes go through to the store and update the
+// cache, so reads never observe stale values written through this map.
+// Cached values are shared between readers and must not be mutated.
+func NewCachedPersistentStringMap(key string, otype interface{}, opts CacheOptions) *PersistentStringMap {
+	m := NewPersistentStringMap(key, otype)
+	m.cache = newValueCache(opts)
+	return m
+}
+
+func (m *PersistentStringMap) CacheStats() CacheStats {
+	return m.cache.stats()
+}
+
+func (m *PersistentStringMap) PurgeCache() {
+	m.cache.purge()
+}
+
+// cacheEncoded caches the value Read would return for b rather than the
+// caller's value, which may be a pointer the caller keeps mutating.
+func (m *PersistentStringMap) cacheEncoded(k string, b []byte) {
+	if m.cache == nil {
+		return
+	}
+	v, err := m.unmarshal(b)
+	if err != nil {
+		m.cache.remove(k)
+		return
+	}
+	m.cache.set(k, v)
+}
+
 func getdb(key string) (*badger.DB, error) {
 	db, err := badger.Open(badger.DefaultOptions(pathname(key)))
 	if err != nil {
@@ -108,20 +158,16 @@ func (m *PersistentStringMap) Write(k string, v interface{}) {
 		return
 	}
 	defer db.Close()
+	var _v []byte
 	if err = db.Update(func(txn *badger.Txn) error {
-		var _v []byte
-		if encoder, ok := v.(MarshalUnmarshaller); ok {
-			_v, _ = encoder.Marshal()
-		} else {
-			_v, err = util.GetBytes(v)
-			if err != nil {
-				log.LogError("get-bytes error:", err)
-			}
-		}
-		return txn.Set([]byte(k), _v)
+		_v = m.marshal(v)
+		return txn.SetEntry(badger.NewEntry([]byte(k), _v).WithMeta(m.version))
 	}); err != nil {
 		log.LogError(err)
+		return
 	}
+	m.cacheEncoded(k, _v)
+	m.notify(k, _v, m.version, false)
 	return
 }
 
@@ -138,13 +184,19 @@ func (m *PersistentStringMap) Delete(k string) {
 		return txn.Delete([]byte(k))
 	}); err != nil {
 		log.LogError(err)
+		return
 	}
+	m.cache.remove(k)
+	m.notify(k, nil, 0, true)
 	return
 }
 
 func (m *PersistentStringMap) Read(k string) (v interface{}) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	if cached, ok := m.cache.get(k); ok {
+		return cached
+	}
 	db, err := badger.Open(badger.DefaultOptions(pathname(m.key)))
 	if err != nil {
 		log.LogError(err)
@@ -159,7 +211,10 @@ func (m *PersistentStringMap) Read(k string) (v interface{}) {
 		}
 		if err = item.Value(func(val []byte) error {
 			var _err error
-			v, _err = m.unmarshal(val)
+			v, _err = m.decode(val, item.UserMeta())
+			if _err == nil {
+				m.cache.set(k, v)
+			}
 			return _err
 		}); err != nil {
 			log.LogError(err)
@@ -174,6 +229,9 @@ func (m *PersistentStringMap) Read(k string) (v interface{}) {
 func (m *PersistentStringMap) ReadOk(k string) (v interface{}, ok bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	if cached, hit := m.cache.get(k); hit {
+		return cached, true
+	}
 	db, err := badger.Open(badger.DefaultOptions(pathname(m.key)))
 	if err != nil {
 		log.LogError(err)
@@ -186,11 +244,16 @@ func (m *PersistentStringMap) ReadOk(k string) (v interface{}, ok bool) {
 			log.LogError(err)
 			return err
 		}
-		ok = true
 		if err = item.Value(func(val []byte) error {
 			var _err error
-			v, _err = m.unmarshal(val)
-			return _err
+			v, _err = m.decode(val, item.UserMeta())
+			if _err != nil {
+				v = nil
+				return _err
+			}
+			ok = true
+			m.cache.set(k, v)
+			return nil
 		}); err != nil {
 			log.LogError(err)
 		}
@@ -0,0 +1,111 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// The schema version is stored in the badger entry's user meta byte, so values
+// written before versioning existed read as version 0.
+const MaxVersion = 255
+
+var ErrNewerVersion = errors.New("value written by a newer schema version")
+
+// MigrationFunc upgrades a value stored at fromVersion to the map's current
+// version. old holds the stored bytes; the result is returned to readers and
+// re-encoded by Migrate.
+type MigrationFunc func(old []byte, fromVersion int) (interface{}, error)
+
+// SetVersion sets the schema version stamped on values written by the map.
+func (m *PersistentStringMap) SetVersion(version int) error {
+	if version < 0 || version > MaxVersion {
+		return fmt.Errorf("version %d out of range [0, %d]", version, MaxVersion)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schemaMu.Lock()
+	m.version = byte(version)
+	m.schemaMu.Unlock()
+	m.cache.purge()
+	return nil
+}
+
+func (m *PersistentStringMap) Version() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int(m.version)
+}
+
+// RegisterMigration sets the function upgrading values stored at fromVersion.
+// Values at an older version without a migration are decoded as-is.
+func (m *PersistentStringMap) RegisterMigration(fromVersion int, f MigrationFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schemaMu.Lock()
+	if m.migrations == nil {
+		m.migrations = make(map[int]MigrationFunc)
+	}
+	m.migrations[fromVersion] = f
+	m.schemaMu.Unlock()
+	m.cache.purge()
+}
+
+// decode unmarshals a stored value, migrating it in memory if it was written
+// at an older version.
+func (m *PersistentStringMap) decode(b []byte, version byte) (interface{}, error) {
+	m.schemaMu.RLock()
+	current, f := m.version, m.migrations[int(version)]
+	m.schemaMu.RUnlock()
+	switch {
+	case version == current:
+		return m.unmarshal(b)
+	case version > current:
+		return nil, ErrNewerVersion
+	}
+	if f != nil {
+		return f(b, int(version))
+	}
+	return m.unmarshal(b)
+}
+
+// Migrate rewrites every value stored at an older version with its migrated
+// form at the current version and returns the number of values rewritten.
+func (m *PersistentStringMap) Migrate() (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	db, err := getdb(m.key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	if err = eachItem(db, func(item *badger.Item) error {
+		if item.UserMeta() >= m.version {
+			return nil
+		}
+		return item.Value(func(val []byte) error {
+			v, err := m.decode(val, item.UserMeta())
+			if err != nil {
+				return fmt.Errorf("migrate %q: %v", item.Key(), err)
+			}
+			if err = wb.SetEntry(badger.NewEntry(item.KeyCopy(nil), m.marshal(v)).WithMeta(m.version)); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+	}); err != nil {
+		return n, err
+	}
+	if err = wb.Flush(); err != nil {
+		return n, err
+	}
+	m.cache.purge()
+	if n > 0 {
+		invalidateWatchers(m.key)
+	}
+	return n, nil
+}
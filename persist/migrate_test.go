@@ -0,0 +1,126 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	util "github.com/alexi/goutil"
+)
+
+// storedVersions returns the schema version of every value in the store key.
+func storedVersions(t *testing.T, key string) map[string]int {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := ExportRaw(key, &buf); err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[string]int)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		versions[rec.Key] = rec.Version
+	}
+	return versions
+}
+
+func countTo(n int) MigrationFunc {
+	return func(old []byte, fromVersion int) (interface{}, error) {
+		var v testValue
+		err := util.DecodeBytes(old, &v)
+		v.Count = n
+		return v, err
+	}
+}
+
+func TestMigrateOnRead(t *testing.T) {
+	chdirTemp(t)
+	NewPersistentStringMap("m", testValue{}).Write("a", testValue{Name: "a"})
+
+	m := NewCachedPersistentStringMap("m", testValue{}, CacheOptions{MaxEntries: 10})
+	if err := m.SetVersion(MaxVersion + 1); err == nil {
+		t.Fatal("SetVersion accepted an out of range version")
+	}
+	if v := m.Read("a"); v != (testValue{Name: "a"}) {
+		t.Fatalf("Read = %v", v)
+	}
+	m.SetVersion(1)
+	if st := m.CacheStats(); st.Entries != 0 {
+		t.Fatalf("SetVersion kept %d cached values", st.Entries)
+	}
+	m.Read("a")
+	m.RegisterMigration(0, countTo(100))
+	if v := m.Read("a"); v != (testValue{Name: "a", Count: 100}) {
+		t.Fatalf("Read after RegisterMigration = %v", v)
+	}
+	if versions := storedVersions(t, "m"); versions["a"] != 0 {
+		t.Fatalf("reading rewrote the value to version %d", versions["a"])
+	}
+
+	m.Write("b", testValue{Name: "b"})
+	if versions := storedVersions(t, "m"); versions["b"] != 1 {
+		t.Fatalf("Write stamped version %d, want 1", versions["b"])
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("m", testValue{})
+	m.Write("a", testValue{Name: "a"})
+	m.SetVersion(1)
+	m.Write("b", testValue{Name: "b"})
+	m.SetVersion(2)
+	m.RegisterMigration(0, countTo(100))
+	m.RegisterMigration(1, countTo(200))
+	m.Write("c", testValue{Name: "c"})
+
+	n, err := m.Migrate()
+	if err != nil || n != 2 {
+		t.Fatalf("Migrate = %d, %v, want 2 values rewritten", n, err)
+	}
+	for k, v := range storedVersions(t, "m") {
+		if v != 2 {
+			t.Errorf("%s is at version %d after Migrate", k, v)
+		}
+	}
+	// no migrations are needed to read the rewritten values
+	fresh := NewPersistentStringMap("m", testValue{})
+	fresh.SetVersion(2)
+	checkTestValues(t, fresh, map[string]testValue{
+		"a": {Name: "a", Count: 100},
+		"b": {Name: "b", Count: 200},
+		"c": {Name: "c"},
+	})
+	if n, err = m.Migrate(); err != nil || n != 0 {
+		t.Fatalf("second Migrate = %d, %v", n, err)
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("m", testValue{})
+	m.SetVersion(2)
+	m.Write("a", testValue{Name: "a"})
+
+	old := NewPersistentStringMap("m", testValue{})
+	old.SetVersion(1)
+	if v := old.Read("a"); v != nil {
+		t.Fatalf("Read of a newer value = %v", v)
+	}
+	if v, ok := old.ReadOk("a"); ok || v != nil {
+		t.Fatalf("ReadOk of a newer value = %v, %v", v, ok)
+	}
+	if err := old.Export(&bytes.Buffer{}); err == nil {
+		t.Fatal("Export of a newer value succeeded")
+	}
+	if _, err := old.decode(nil, 2); err != ErrNewerVersion {
+		t.Fatalf("decode = %v, want ErrNewerVersion", err)
+	}
+	if n, err := old.Migrate(); err != nil || n != 0 {
+		t.Fatalf("Migrate = %d, %v, newer values must be left alone", n, err)
+	}
+}
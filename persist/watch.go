@@ -0,0 +1,261 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+
+	log "github.com/alexi/goutil/log"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	// EventOverflow is the last event sent to a watcher that fell more than
+	// WatchBufferSize events behind, or whose store was rewritten in bulk by
+	// Restore, Import or Migrate; its channel is closed right after and the
+	// receiver should re-read whatever state it tracks and watch again.
+	EventOverflow
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventOverflow:
+		return "overflow"
+	default:
+		return ""
+	}
+}
+
+// Event describes a change to a key. Value is decoded with the watching map's
+// type instance and is nil for deletes and overflows.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value interface{}
+}
+
+// Number of events buffered per watcher before it overflows.
+var WatchBufferSize = 64
+
+// Prefix of badger's internal keys, such as transaction markers.
+var badgerPrefix = []byte("!badger!")
+
+type watcher struct {
+	m      *PersistentStringMap
+	prefix string
+	size   int
+	mu     sync.Mutex
+	ch     chan Event
+	closed bool
+}
+
+// watchHub fans out changes to the watchers of one store, so maps opened on the
+// same key see each other's writes.
+type watchHub struct {
+	mu       sync.RWMutex
+	watchers map[*watcher]bool
+}
+
+var (
+	hubsMu sync.Mutex
+	hubs   = make(map[string]*watchHub)
+)
+
+func getHub(key string, create bool) *watchHub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	h := hubs[key]
+	if h == nil && create {
+		h = &watchHub{watchers: make(map[*watcher]bool)}
+		hubs[key] = h
+	}
+	return h
+}
+
+func (h *watchHub) add(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchers[w] = true
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watchers, w)
+}
+
+// publish delivers a stored value (or a delete when deleted is set) to every
+// watcher whose prefix matches k.
+func (h *watchHub) publish(k string, b []byte, version byte, deleted bool) {
+	h.mu.RLock()
+	watchers := make([]*watcher, 0, len(h.watchers))
+	for w := range h.watchers {
+		if strings.HasPrefix(k, w.prefix) {
+			watchers = append(watchers, w)
+		}
+	}
+	h.mu.RUnlock()
+
+	decoded := make(map[*PersistentStringMap]interface{})
+	for _, w := range watchers {
+		ev := Event{Type: EventDelete, Key: k}
+		if !deleted {
+			v, ok := decoded[w.m]
+			if !ok {
+				var err error
+				if v, err = w.m.decode(b, version); err != nil {
+					log.LogError("watch decode error:", k, err)
+				}
+				decoded[w.m] = v
+			}
+			ev = Event{Type: EventPut, Key: k, Value: v}
+		}
+		if !w.send(ev) {
+			h.remove(w)
+		}
+	}
+}
+
+// send never blocks; it returns false once the watcher is closed.
+func (w *watcher) send(ev Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	if len(w.ch) >= w.size {
+		w.overflow()
+		return false
+	}
+	w.ch <- ev
+	return true
+}
+
+// overflow must be called with w.mu held.
+func (w *watcher) overflow() {
+	if !w.closed {
+		// the channel has one spare slot reserved for the overflow event
+		w.ch <- Event{Type: EventOverflow}
+		w.close()
+	}
+}
+
+// close must be called with w.mu held.
+func (w *watcher) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
+
+// Watch returns a channel of changes to keys starting with prefix, made
+// through any map on the same store in this process (and forwarded by
+// WatchDB). Delivery never blocks writers: a watcher that falls behind receives
+// EventOverflow and its channel is closed, as do all watchers of a store after
+// a bulk change. cancel stops the watch and closes the channel.
+func (m *PersistentStringMap) Watch(prefix string) (<-chan Event, func()) {
+	size := WatchBufferSize
+	if size < 1 {
+		size = 1
+	}
+	w := &watcher{
+		m:      m,
+		prefix: prefix,
+		size:   size,
+		ch:     make(chan Event, size+1),
+	}
+	h := getHub(m.key, true)
+	h.add(w)
+	cancel := func() {
+		h.remove(w)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.close()
+	}
+	return w.ch, cancel
+}
+
+// WatchDB forwards changes committed through db, a handle opened outside this
+// package on the map's store, to the map's watchers using badger's Subscribe.
+// It blocks until ctx is done.
+//
+// badger allows one open handle per store, and the map opens the store on
+// every call, so the map's own reads and writes fail while db is open. Use
+// WatchDB to follow a store written by other code, not alongside the map.
+func (m *PersistentStringMap) WatchDB(ctx context.Context, db *badger.DB) error {
+	return db.Subscribe(ctx, func(kvs *badger.KVList) error {
+		h := getHub(m.key, false)
+		if h == nil {
+			return nil
+		}
+		for _, kv := range kvs.Kv {
+			if bytes.HasPrefix(kv.Key, badgerPrefix) {
+				continue
+			}
+			var version byte
+			if len(kv.Meta) > 0 {
+				version = kv.Meta[0]
+			}
+			deleted := len(kv.Value) == 0 && isDeleted(db, kv.Key, kv.Version)
+			h.publish(string(kv.Key), kv.Value, version, deleted)
+		}
+		return nil
+	}, []byte{})
+}
+
+// isDeleted reports whether the given version of key is a delete marker.
+// Subscribers get deletes as empty values without badger's delete flag, so an
+// empty value is looked up to tell a delete from a put of an empty value.
+// Versions no longer found, such as ones already garbage collected, count as
+// deletes.
+func isDeleted(db *badger.DB, key []byte, version uint64) bool {
+	deleted := true
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewKeyIterator(key, opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if item := it.Item(); item.Version() == version {
+				deleted = item.IsDeletedOrExpired()
+				break
+			}
+		}
+		return nil
+	})
+	return deleted
+}
+
+func (m *PersistentStringMap) notify(k string, b []byte, version byte, deleted bool) {
+	if h := getHub(m.key, false); h != nil {
+		h.publish(k, b, version, deleted)
+	}
+}
+
+// invalidateWatchers sends EventOverflow to every watcher of the store key,
+// for changes made in bulk rather than key by key.
+func invalidateWatchers(key string) {
+	h := getHub(key, false)
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	watchers := h.watchers
+	h.watchers = make(map[*watcher]bool)
+	h.mu.Unlock()
+	for w := range watchers {
+		w.mu.Lock()
+		w.overflow()
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,182 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	util "github.com/alexi/goutil"
+
+	badger "github.com/dgraph-io/badger"
+)
+
+// drain returns the events already delivered to ch and whether ch is closed.
+func drain(ch <-chan Event) (events []Event, closed bool) {
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return events, true
+			}
+			events = append(events, ev)
+		default:
+			return events, false
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("w", testValue{})
+	other := NewPersistentStringMap("w", testValue{})
+	ch, cancel := m.Watch("a")
+
+	other.Write("a1", testValue{Name: "a1"})
+	other.Write("b1", testValue{Name: "b1"})
+	m.Delete("a1")
+	events, closed := drain(ch)
+	want := []Event{
+		{Type: EventPut, Key: "a1", Value: testValue{Name: "a1"}},
+		{Type: EventDelete, Key: "a1"},
+	}
+	if closed || !reflect.DeepEqual(events, want) {
+		t.Fatalf("events = %v, closed %v, want %v", events, closed, want)
+	}
+
+	cancel()
+	if _, closed = drain(ch); !closed {
+		t.Fatal("cancel did not close the channel")
+	}
+	cancel()
+	m.Write("a2", testValue{})
+}
+
+func TestWatchOverflow(t *testing.T) {
+	chdirTemp(t)
+	defer func(size int) { WatchBufferSize = size }(WatchBufferSize)
+	WatchBufferSize = 2
+	m := NewPersistentStringMap("w", testValue{})
+	ch, cancel := m.Watch("")
+	defer cancel()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		m.Write(k, testValue{Name: k})
+	}
+	events, closed := drain(ch)
+	if len(events) != 3 || events[1].Key != "b" || events[2].Type != EventOverflow || !closed {
+		t.Fatalf("events = %v, closed %v, want a, b, overflow and close", events, closed)
+	}
+}
+
+func TestWatchBulkChanges(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("w", testValue{})
+	m.Write("a", testValue{Name: "a"})
+	var backup, export bytes.Buffer
+	if err := m.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOverflow := func(name string, change func() error) {
+		t.Helper()
+		ch, cancel := m.Watch("")
+		defer cancel()
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		events, closed := drain(ch)
+		if len(events) != 1 || events[0].Type != EventOverflow || !closed {
+			t.Errorf("%s: events = %v, closed %v, want overflow and close", name, events, closed)
+		}
+	}
+	expectOverflow("Restore", func() error { return m.Restore(&backup) })
+	expectOverflow("Import", func() error { return m.Import(&export) })
+	m.SetVersion(1)
+	m.RegisterMigration(0, countTo(1))
+	expectOverflow("Migrate", func() error {
+		_, err := m.Migrate()
+		return err
+	})
+}
+
+func TestWatchDB(t *testing.T) {
+	chdirTemp(t)
+	m := NewPersistentStringMap("w", testValue{})
+	m.Write("init", testValue{}) // creates the store
+	ch, cancel := m.Watch("k")
+	defer cancel()
+
+	db, err := badger.Open(badger.DefaultOptions(pathname("w")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.WatchDB(ctx, db) }()
+
+	b, err := util.GetBytes(testValue{Name: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription starts asynchronously, so write until it sees a change
+	deadline := time.After(5 * time.Second)
+	var ev Event
+wait:
+	for {
+		if err = db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("k"), b)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev = <-ch:
+			break wait
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no event forwarded")
+		}
+	}
+	if ev.Type != EventPut || ev.Key != "k" || ev.Value != (testValue{Name: "k"}) {
+		t.Fatalf("event = %+v", ev)
+	}
+	if err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("k"), []byte{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("k"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	next := func() Event {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-deadline:
+			t.Fatal("event not forwarded")
+		}
+		return Event{}
+	}
+	// skip puts from the writes above that were still in flight
+	for ev.Type == EventPut && ev.Value == (testValue{Name: "k"}) {
+		ev = next()
+	}
+	if ev.Type != EventPut || ev.Key != "k" {
+		t.Fatalf("event = %+v, want a put of the empty value", ev)
+	}
+	if ev = next(); ev.Type != EventDelete || ev.Key != "k" {
+		t.Fatalf("event = %+v, want a delete", ev)
+	}
+
+	stop()
+	if err = <-done; err != context.Canceled {
+		t.Fatalf("WatchDB = %v, want context.Canceled", err)
+	}
+}
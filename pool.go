@@ -0,0 +1,132 @@
+package goutil
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// PanicError is returned for a Pool task that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// Pool runs func(ctx) error tasks with at most the Threader's thread count
+// running at once. By default the first failing task cancels the context
+// passed to the others, and tasks that have not started by then are skipped.
+type Pool struct {
+	threader *Threader
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	errs      []error
+	keepGoing bool
+}
+
+func NewPool(ctx context.Context, numThreads int) *Pool {
+	return NewPoolWithThreader(ctx, NewThreader(numThreads))
+}
+
+// NewPoolWithThreader returns a Pool limited by t, which may be shared with
+// other users of the Threader.
+func NewPoolWithThreader(ctx context.Context, t *Threader) *Pool {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pool{threader: t, ctx: ctx, cancel: cancel}
+}
+
+// ContinueOnError makes failing tasks not cancel the others, so that Errors
+// reports the outcome of every task.
+func (p *Pool) ContinueOnError() *Pool {
+	p.mu.Lock()
+	p.keepGoing = true
+	p.mu.Unlock()
+	return p
+}
+
+// Go queues task. It returns immediately; the task starts once a thread is
+// free, unless the pool's context is done by then.
+func (p *Pool) Go(task func(ctx context.Context) error) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if p.threader.AcquireContext(p.ctx) != nil {
+			return
+		}
+		defer p.threader.Release()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err := p.run(task); err != nil {
+			p.fail(err)
+		}
+	}()
+}
+
+func (p *Pool) run(task func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return task(p.ctx)
+}
+
+func (p *Pool) fail(err error) {
+	p.mu.Lock()
+	p.errs = append(p.errs, err)
+	keepGoing := p.keepGoing
+	p.mu.Unlock()
+	if !keepGoing {
+		p.cancel()
+	}
+}
+
+// Wait waits for all queued tasks and returns the first error, if any. The
+// pool's context is cancelled afterwards, so the pool cannot be reused.
+func (p *Pool) Wait() error {
+	p.wg.Wait()
+	p.cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.errs) > 0 {
+		return p.errs[0]
+	}
+	return nil
+}
+
+// Errors returns the errors of all failed tasks so far, in the order they
+// failed.
+func (p *Pool) Errors() []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]error(nil), p.errs...)
+}
+
+// Cancel cancels the context of running tasks and skips queued ones.
+func (p *Pool) Cancel() {
+	p.cancel()
+}
+
+// Context returns the context passed to tasks.
+func (p *Pool) Context() context.Context {
+	return p.ctx
+}
+
+func (p *Pool) SetThreadCount(numThreads int) {
+	p.threader.SetThreadCount(numThreads)
+}
+
+func (p *Pool) GetThreadCount() int {
+	return p.threader.GetThreadCount()
+}
@@ -0,0 +1,323 @@
+package goutil
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket: it holds up to burst tokens, refilled at rate
+// tokens per second, and each event takes one. A rate of zero or less does not
+// limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a full bucket allowing perSecond events per second
+// on average and bursts of up to burst events.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// NewLeakyBucket returns a limiter that spaces events evenly at perSecond,
+// queueing Wait calls instead of letting bursts through.
+func NewLeakyBucket(perSecond float64) *RateLimiter {
+	return NewRateLimiter(perSecond, 1)
+}
+
+// advance must be called with l.mu held.
+func (l *RateLimiter) advance(now time.Time) {
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+}
+
+// reserve takes n tokens and returns how long to wait until they are due, or
+// false without taking them if that is longer than maxWait.
+func (l *RateLimiter) reserve(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, true
+	}
+	if float64(n) > l.burst {
+		return 0, false
+	}
+	l.advance(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if wait > maxWait {
+		l.tokens += float64(n)
+		return 0, false
+	}
+	return wait, true
+}
+
+func (l *RateLimiter) unreserve(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+float64(n))
+}
+
+func (l *RateLimiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN takes n tokens if they are available now.
+func (l *RateLimiter) AllowN(n int) bool {
+	_, ok := l.reserve(time.Now(), n, 0)
+	return ok
+}
+
+// Wait blocks until an event is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n events are allowed. It fails right away with
+// ErrExceedsBurst if n is more than the burst, and with
+// context.DeadlineExceeded if ctx expires before the tokens are due. A nil ctx
+// waits forever.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	maxWait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(now)
+	}
+	wait, ok := l.reserve(now, n, maxWait)
+	if !ok {
+		if float64(n) > l.Burst() && l.Rate() > 0 {
+			return ErrExceedsBurst
+		}
+		return context.DeadlineExceeded
+	}
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.unreserve(n)
+		return ctx.Err()
+	}
+}
+
+// SetRate changes the refill rate; tokens accrued so far are kept.
+func (l *RateLimiter) SetRate(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	l.rate = perSecond
+}
+
+func (l *RateLimiter) SetBurst(burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	l.burst = float64(burst)
+	l.tokens = math.Min(l.burst, l.tokens)
+}
+
+func (l *RateLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *RateLimiter) Burst() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.burst
+}
+
+// Tokens returns the tokens available now; it is negative while Wait calls
+// are queued.
+func (l *RateLimiter) Tokens() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	return l.tokens
+}
+
+// full reports whether the bucket has refilled completely, in which case it
+// is indistinguishable from a new one.
+func (l *RateLimiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(now)
+	return l.tokens >= l.burst
+}
+
+// KeyedRateLimiter keeps a RateLimiter per key, such as one per tenant.
+// Limiters unused for the idle time are dropped once their bucket has refilled,
+// so memory is bounded by the recently active keys.
+type KeyedRateLimiter[K comparable] struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	idle      time.Duration
+	limiters  map[K]*keyedLimiter
+	overrides map[K][2]float64
+	lastSweep time.Time
+}
+
+type keyedLimiter struct {
+	*RateLimiter
+	lastUsed time.Time
+}
+
+// NewKeyedRateLimiter returns a KeyedRateLimiter giving every key perSecond
+// and burst unless overridden with SetKeyLimit. An idle time of zero defaults
+// to a minute.
+func NewKeyedRateLimiter[K comparable](perSecond float64, burst int, idle time.Duration) *KeyedRateLimiter[K] {
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	return &KeyedRateLimiter[K]{
+		rate:      perSecond,
+		burst:     burst,
+		idle:      idle,
+		limiters:  make(map[K]*keyedLimiter),
+		overrides: make(map[K][2]float64),
+	}
+}
+
+// SetKeyLimit gives k its own rate and burst.
+func (m *KeyedRateLimiter[K]) SetKeyLimit(k K, perSecond float64, burst int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[k] = [2]float64{perSecond, float64(burst)}
+	if l := m.limiters[k]; l != nil {
+		l.SetRate(perSecond)
+		l.SetBurst(burst)
+	}
+}
+
+// ClearKeyLimit returns k to the default rate and burst.
+func (m *KeyedRateLimiter[K]) ClearKeyLimit(k K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, k)
+	if l := m.limiters[k]; l != nil {
+		l.SetRate(m.rate)
+		l.SetBurst(m.burst)
+	}
+}
+
+// Limiter returns the RateLimiter of k, creating it if needed.
+func (m *KeyedRateLimiter[K]) Limiter(k K) *RateLimiter {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) >= m.idle {
+		m.sweep(now)
+	}
+	l := m.limiters[k]
+	if l == nil {
+		if o, ok := m.overrides[k]; ok {
+			l = &keyedLimiter{RateLimiter: NewRateLimiter(o[0], int(o[1]))}
+		} else {
+			l = &keyedLimiter{RateLimiter: NewRateLimiter(m.rate, m.burst)}
+		}
+		m.limiters[k] = l
+	}
+	l.lastUsed = now
+	return l.RateLimiter
+}
+
+// sweep must be called with m.mu held.
+func (m *KeyedRateLimiter[K]) sweep(now time.Time) {
+	m.lastSweep = now
+	for k, l := range m.limiters {
+		if now.Sub(l.lastUsed) >= m.idle && l.full(now) {
+			delete(m.limiters, k)
+		}
+	}
+}
+
+func (m *KeyedRateLimiter[K]) Allow(k K) bool {
+	return m.Limiter(k).Allow()
+}
+
+func (m *KeyedRateLimiter[K]) Wait(ctx context.Context, k K) error {
+	return m.Limiter(k).Wait(ctx)
+}
+
+// Len returns the number of keys with a live limiter.
+func (m *KeyedRateLimiter[K]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.limiters)
+}
+
+// Throttle bounds both the number of concurrent calls and the rate at which
+// they start.
+type Throttle struct {
+	Threader *Threader
+	Limiter  *RateLimiter
+}
+
+func NewThrottle(numThreads int, perSecond float64, burst int) *Throttle {
+	return &Throttle{
+		Threader: NewThreader(numThreads),
+		Limiter:  NewRateLimiter(perSecond, burst),
+	}
+}
+
+// Acquire waits for the rate limit and then takes a thread, so callers held
+// back by the rate do not occupy threads; the thread must be returned with
+// Release if it succeeds. The token is given back if no thread is free before
+// ctx is done.
+func (t *Throttle) Acquire(ctx context.Context) error {
+	if err := t.Limiter.Wait(ctx); err != nil {
+		return err
+	}
+	if err := t.Threader.AcquireContext(ctx); err != nil {
+		t.Limiter.unreserve(1)
+		return err
+	}
+	return nil
+}
+
+func (t *Throttle) Release() {
+	t.Threader.Release()
+}
+
+// Do runs f once Acquire succeeds.
+func (t *Throttle) Do(ctx context.Context, f func() error) error {
+	if err := t.Acquire(ctx); err != nil {
+		return err
+	}
+	defer t.Release()
+	return f()
+}
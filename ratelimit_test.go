@@ -0,0 +1,102 @@
+package goutil
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(100, 5)
+	for i := 0; i < 5; i++ {
+		if !l.Allow() {
+			t.Fatalf("burst event %d not allowed", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("event allowed beyond the burst")
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("5 events at 100/s took %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := NewLeakyBucket(1).WaitN(ctx, 2); err != ErrExceedsBurst {
+		t.Errorf("WaitN beyond the burst returned %v", err)
+	}
+	l = NewLeakyBucket(1)
+	l.Allow()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait past the deadline returned %v", err)
+	}
+	if tokens := l.Tokens(); tokens > 0.5 {
+		t.Errorf("failed Wait left %v tokens", tokens)
+	}
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	m := NewKeyedRateLimiter[string](1000, 1, 10*time.Millisecond)
+	m.SetKeyLimit("big", 1000, 3)
+	if !m.Allow("a") || m.Allow("a") {
+		t.Error("key a does not have a burst of 1")
+	}
+	if !m.Allow("b") {
+		t.Error("key b limited by key a")
+	}
+	for i := 0; i < 3; i++ {
+		if !m.Allow("big") {
+			t.Errorf("overridden burst event %d not allowed", i)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	m.Allow("c")
+	if n := m.Len(); n != 1 {
+		t.Errorf("%d limiters left after idle eviction, want 1", n)
+	}
+	for i := 0; i < 3; i++ {
+		if !m.Allow("big") {
+			t.Errorf("override lost after eviction at event %d", i)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := NewThrottle(2, 1000, 1)
+	p := NewPool(context.Background(), 10)
+	for i := 0; i < 10; i++ {
+		p.Go(func(ctx context.Context) error {
+			return th.Do(ctx, func() error {
+				if n := th.Threader.Stats().Running; n > 2 {
+					t.Errorf("%d calls running, limit is 2", n)
+				}
+				return nil
+			})
+		})
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a caller that gets a token but no thread gives the token back
+	th = NewThrottle(1, 1, 1)
+	if err := th.Acquire(nil); err != nil {
+		t.Fatal(err)
+	}
+	th.Limiter.unreserve(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := th.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire with no free thread returned %v", err)
+	}
+	if tokens := th.Limiter.Tokens(); tokens < 1 {
+		t.Errorf("%v tokens left after a failed Acquire, want 1", tokens)
+	}
+	th.Release()
+}
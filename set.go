@@ -1,36 +1,62 @@
 package goutil
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"sync"
 )
 
-type StringSet struct {
-	m map[string]bool
+// Set is a thread-safe set. The zero value is an empty set ready to use.
+// Operations involving two sets lock them one at a time, so they are safe to
+// call on the same sets concurrently in any order, but do not see a single
+// point-in-time state of both.
+type Set[T comparable] struct {
+	m map[T]struct{}
 	sync.RWMutex
 }
 
-func NewStringSet() *StringSet {
-	return &StringSet{
-		m: make(map[string]bool),
+func NewSet[T comparable](items ...T) *Set[T] {
+	s := &Set[T]{m: make(map[T]struct{}, len(items))}
+	for _, item := range items {
+		s.m[item] = struct{}{}
 	}
+	return s
 }
 
 // Add add
-func (s *StringSet) Add(item string) {
+func (s *Set[T]) Add(item T) {
+	s.Lock()
+	defer s.Unlock()
+	s.add(item)
+}
+
+// add must be called with the write lock held.
+func (s *Set[T]) add(item T) {
+	if s.m == nil {
+		s.m = make(map[T]struct{})
+	}
+	s.m[item] = struct{}{}
+}
+
+// AddAll adds all items under a single lock.
+func (s *Set[T]) AddAll(items ...T) {
 	s.Lock()
 	defer s.Unlock()
-	s.m[item] = true
+	for _, item := range items {
+		s.add(item)
+	}
 }
 
 // Remove deletes the specified item from the map
-func (s *StringSet) Remove(item string) {
+func (s *Set[T]) Remove(item T) {
 	s.Lock()
 	defer s.Unlock()
 	delete(s.m, item)
 }
 
 // Has looks for the existence of an item
-func (s *StringSet) Has(item string) bool {
+func (s *Set[T]) Has(item T) bool {
 	s.RLock()
 	defer s.RUnlock()
 	_, ok := s.m[item]
@@ -38,96 +64,165 @@ func (s *StringSet) Has(item string) bool {
 }
 
 // Len returns the number of items in a set.
-func (s *StringSet) Len() int {
-	return len(s.List())
+func (s *Set[T]) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.m)
 }
 
 // Clear removes all items from the set
-func (s *StringSet) Clear() {
+func (s *Set[T]) Clear() {
 	s.Lock()
 	defer s.Unlock()
-	s.m = make(map[string]bool)
+	s.m = make(map[T]struct{})
 }
 
 // IsEmpty checks for emptiness
-func (s *StringSet) IsEmpty() bool {
-	if s.Len() == 0 {
-		return true
-	}
-	return false
+func (s *Set[T]) IsEmpty() bool {
+	return s.Len() == 0
 }
 
-// StringSet returns a slice of all items
-func (s *StringSet) List() []string {
+// List returns a slice of all items
+func (s *Set[T]) List() []T {
 	s.RLock()
 	defer s.RUnlock()
-	list := make([]string, 0)
+	list := make([]T, 0, len(s.m))
 	for item := range s.m {
 		list = append(list, item)
 	}
 	return list
 }
 
-type Uint64Set struct {
-	m map[uint64]bool
-	sync.RWMutex
+// Range calls f for each item until f returns false. The set is read-locked
+// meanwhile, so f must not modify it; range over List or Clone to do so.
+func (s *Set[T]) Range(f func(item T) bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for item := range s.m {
+		if !f(item) {
+			return
+		}
+	}
 }
 
-func NewUint64Set() *Uint64Set {
-	return &Uint64Set{
-		m: make(map[uint64]bool),
+// Clone returns a snapshot of the set.
+func (s *Set[T]) Clone() *Set[T] {
+	s.RLock()
+	defer s.RUnlock()
+	out := &Set[T]{m: make(map[T]struct{}, len(s.m))}
+	for item := range s.m {
+		out.m[item] = struct{}{}
 	}
+	return out
 }
 
-// Add add
-func (s *Uint64Set) Add(item uint64) {
-	s.Lock()
-	defer s.Unlock()
-	s.m[item] = true
+// Union returns a new set of the items in s or o.
+func (s *Set[T]) Union(o *Set[T]) *Set[T] {
+	out := s.Clone()
+	o.Range(func(item T) bool {
+		out.m[item] = struct{}{}
+		return true
+	})
+	return out
+}
+
+// Intersect returns a new set of the items in both s and o.
+func (s *Set[T]) Intersect(o *Set[T]) *Set[T] {
+	other := o.Clone()
+	out := NewSet[T]()
+	s.Range(func(item T) bool {
+		if _, ok := other.m[item]; ok {
+			out.m[item] = struct{}{}
+		}
+		return true
+	})
+	return out
 }
 
-// Remove deletes the specified item from the map
-func (s *Uint64Set) Remove(item uint64) {
-	s.Lock()
-	defer s.Unlock()
-	delete(s.m, item)
+// Difference returns a new set of the items in s but not in o.
+func (s *Set[T]) Difference(o *Set[T]) *Set[T] {
+	out := s.Clone()
+	o.Range(func(item T) bool {
+		delete(out.m, item)
+		return true
+	})
+	return out
 }
 
-// Has looks for the existence of an item
-func (s *Uint64Set) Has(item uint64) bool {
-	s.RLock()
-	defer s.RUnlock()
-	_, ok := s.m[item]
-	return ok
+// IsSubset reports whether every item of s is in o.
+func (s *Set[T]) IsSubset(o *Set[T]) bool {
+	other := o.Clone()
+	subset := true
+	s.Range(func(item T) bool {
+		_, subset = other.m[item]
+		return subset
+	})
+	return subset
 }
 
-// Len returns the number of items in a set.
-func (s *Uint64Set) Len() int {
-	return len(s.List())
+// Equal reports whether s and o hold the same items.
+func (s *Set[T]) Equal(o *Set[T]) bool {
+	return s.Len() == o.Len() && s.IsSubset(o)
 }
 
-// Clear removes all items from the set
-func (s *Uint64Set) Clear() {
-	s.Lock()
-	defer s.Unlock()
-	s.m = make(map[uint64]bool)
+// MarshalJSON encodes the set as an array, in no particular order.
+func (s *Set[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.List())
 }
 
-// IsEmpty checks for emptiness
-func (s *Uint64Set) IsEmpty() bool {
-	if s.Len() == 0 {
-		return true
+func (s *Set[T]) UnmarshalJSON(b []byte) error {
+	var items []T
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
 	}
-	return false
+	s.replace(items)
+	return nil
 }
 
-// Uint64Set returns a slice of all items
-func (s *Uint64Set) List() Uint64s {
-	s.RLock()
-	defer s.RUnlock()
-	list := make(Uint64s, 0)
-	for item := range s.m {
-		list = append(list, item)
+func (s *Set[T]) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.List()); err != nil {
+		return nil, err
 	}
-	return list
+	return buf.Bytes(), nil
+}
+
+func (s *Set[T]) GobDecode(b []byte) error {
+	var items []T
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&items); err != nil {
+		return err
+	}
+	s.replace(items)
+	return nil
+}
+
+func (s *Set[T]) replace(items []T) {
+	m := make(map[T]struct{}, len(items))
+	for _, item := range items {
+		m[item] = struct{}{}
+	}
+	s.Lock()
+	s.m = m
+	s.Unlock()
+}
+
+type StringSet struct {
+	Set[string]
+}
+
+func NewStringSet() *StringSet {
+	return &StringSet{}
+}
+
+type Uint64Set struct {
+	Set[uint64]
+}
+
+func NewUint64Set() *Uint64Set {
+	return &Uint64Set{}
+}
+
+// List returns a slice of all items
+func (s *Uint64Set) List() Uint64s {
+	return s.Set.List()
 }
@@ -0,0 +1,128 @@
+package goutil
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	a := NewSet(1, 2, 3)
+	b := NewSet(2, 3, 4)
+	sorted := func(s *Set[int]) []int {
+		l := s.List()
+		sort.Ints(l)
+		return l
+	}
+	for name, c := range map[string]struct {
+		got  *Set[int]
+		want []int
+	}{
+		"union":      {a.Union(b), []int{1, 2, 3, 4}},
+		"intersect":  {a.Intersect(b), []int{2, 3}},
+		"difference": {a.Difference(b), []int{1}},
+		"self":       {a.Union(a), []int{1, 2, 3}},
+	} {
+		if got := sorted(c.got); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s = %v, want %v", name, got, c.want)
+		}
+	}
+	if !a.Intersect(b).IsSubset(a) || a.IsSubset(b) {
+		t.Error("IsSubset is wrong")
+	}
+
+	var s Uint64Set
+	s.AddAll(5, 6, 5)
+	if s.Len() != 2 || !s.Has(6) {
+		t.Errorf("zero value Uint64Set holds %v", s.List())
+	}
+	b2, err := json.Marshal(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s2 Uint64Set
+	if err := json.Unmarshal(b2, &s2); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.Equal(&s.Set) {
+		t.Errorf("JSON round trip gave %v, want %v", s2.List(), s.List())
+	}
+
+	var buf bytes.Buffer
+	ss := NewStringSet()
+	ss.Add("x")
+	if err := gob.NewEncoder(&buf).Encode(ss); err != nil {
+		t.Fatal(err)
+	}
+	var ss2 StringSet
+	if err := gob.NewDecoder(&buf).Decode(&ss2); err != nil {
+		t.Fatal(err)
+	}
+	if !ss2.Has("x") || ss2.Len() != 1 {
+		t.Errorf("gob round trip gave %v", ss2.List())
+	}
+}
+
+func TestOrderedSet(t *testing.T) {
+	s := NewOrderedUint64Set()
+	var want []uint64
+	for i := uint64(0); i < 2000; i++ {
+		v := (i * 7919) % 2000 * 2 // even numbers below 4000, shuffled
+		if !s.Add(v) {
+			t.Fatalf("Add(%d) reported a duplicate", v)
+		}
+		want = append(want, i*2)
+	}
+	if s.Add(10) {
+		t.Error("Add of an existing item reported it as new")
+	}
+	if got := s.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("List is not sorted: %v...", got[:10])
+	}
+	for i := 0; i < 2000; i += 97 {
+		if v, _ := s.Select(i); v != uint64(i*2) {
+			t.Errorf("Select(%d) = %d, want %d", i, v, i*2)
+		}
+		if r := s.Rank(uint64(i*2 + 1)); r != i+1 {
+			t.Errorf("Rank(%d) = %d, want %d", i*2+1, r, i+1)
+		}
+	}
+	if v, ok := s.Floor(101); !ok || v != 100 {
+		t.Errorf("Floor(101) = %d, %v", v, ok)
+	}
+	if v, ok := s.Ceiling(101); !ok || v != 102 {
+		t.Errorf("Ceiling(101) = %d, %v", v, ok)
+	}
+	if _, ok := s.Ceiling(4000); ok {
+		t.Error("Ceiling past the max found an item")
+	}
+	for i := uint64(0); i < 4000; i += 4 {
+		if !s.Remove(i) {
+			t.Fatalf("Remove(%d) found nothing", i)
+		}
+	}
+	var got []uint64
+	s.Range(10, 20, func(v uint64) bool {
+		got = append(got, v)
+		return true
+	})
+	if !reflect.DeepEqual(got, []uint64{10, 14, 18}) {
+		t.Errorf("Range(10, 20) = %v", got)
+	}
+	min, _ := s.Min()
+	max, _ := s.Max()
+	if min != 2 || max != 3998 || s.Len() != 1000 {
+		t.Errorf("min %d, max %d, len %d after removals", min, max, s.Len())
+	}
+	if v, _ := s.Select(500); v != 2002 {
+		t.Errorf("Select(500) = %d after removals, want 2002", v)
+	}
+
+	var empty OrderedStringSet
+	if _, ok := empty.Min(); ok || empty.Remove("a") || empty.Rank("a") != 0 {
+		t.Error("zero value OrderedStringSet is not empty")
+	}
+}
@@ -0,0 +1,186 @@
+package goutil
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShardedUint64Counter is a Uint64Counter split into independently locked
+// shards by key hash, so that increments of different keys rarely contend.
+// Whole-counter reads such as Total, Snapshot and TopK visit the shards one at
+// a time and are not a single point-in-time view.
+type ShardedUint64Counter struct {
+	shards []counterShard
+	mask   uint64
+}
+
+type counterShard struct {
+	Uint64Counter
+	_ [64]byte // keep shards on separate cache lines
+}
+
+// NewShardedUint64Counter returns a counter with n shards rounded up to a
+// power of two; n <= 0 picks four per GOMAXPROCS.
+func NewShardedUint64Counter(n int) *ShardedUint64Counter {
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	s := &ShardedUint64Counter{shards: make([]counterShard, size), mask: uint64(size - 1)}
+	for i := range s.shards {
+		s.shards[i].m = make(map[uint64]int)
+	}
+	return s
+}
+
+func (s *ShardedUint64Counter) shard(k uint64) *Uint64Counter {
+	return &s.shards[mix64(k)&s.mask].Uint64Counter
+}
+
+// SetHalfLife turns decay mode on, or off with zero, for every shard.
+func (s *ShardedUint64Counter) SetHalfLife(halfLife time.Duration) {
+	for i := range s.shards {
+		s.shards[i].SetHalfLife(halfLife)
+	}
+}
+
+func (s *ShardedUint64Counter) Increment(k uint64) {
+	s.shard(k).Add(k, 1)
+}
+
+func (s *ShardedUint64Counter) Decrement(k uint64) {
+	s.shard(k).Add(k, -1)
+}
+
+func (s *ShardedUint64Counter) Add(k uint64, n int) {
+	s.shard(k).Add(k, n)
+}
+
+func (s *ShardedUint64Counter) Remove(k uint64) {
+	s.shard(k).Remove(k)
+}
+
+func (s *ShardedUint64Counter) Get(k uint64) int {
+	return s.shard(k).Get(k)
+}
+
+func (s *ShardedUint64Counter) Total() int {
+	total := 0
+	for i := range s.shards {
+		total += s.shards[i].Total()
+	}
+	return total
+}
+
+func (s *ShardedUint64Counter) Len() int {
+	n := 0
+	for i := range s.shards {
+		n += s.shards[i].Len()
+	}
+	return n
+}
+
+func (s *ShardedUint64Counter) Snapshot() map[uint64]int {
+	out := make(map[uint64]int)
+	s.Range(func(k uint64, count int) bool {
+		out[k] = count
+		return true
+	})
+	return out
+}
+
+// Range calls f for each key and count until f returns false. Each shard is
+// locked while it is visited, so f must not modify the counter.
+func (s *ShardedUint64Counter) Range(f func(k uint64, count int) bool) {
+	more := true
+	for i := range s.shards {
+		s.shards[i].Range(func(k uint64, count int) bool {
+			more = f(k, count)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// TopK returns the k keys with the highest counts, highest first.
+func (s *ShardedUint64Counter) TopK(k int) []Uint64Count {
+	if k <= 0 {
+		return nil
+	}
+	var all []Uint64Count
+	for i := range s.shards {
+		all = append(all, s.shards[i].TopK(k)...)
+	}
+	sort.Slice(all, func(i, j int) bool { return countLess(all[j], all[i]) })
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+// StripedCounter is a single int64 counter for increments from many
+// goroutines at once. Increments go to one of several cells, picked through a
+// sync.Pool so that each P tends to reuse its own cell, and Get sums the
+// cells. The zero value is not usable; use NewStripedCounter.
+type StripedCounter struct {
+	cells []counterCell
+	next  uint32
+	pool  sync.Pool
+}
+
+type counterCell struct {
+	v int64
+	_ [56]byte // one cell per cache line
+}
+
+func NewStripedCounter() *StripedCounter {
+	c := &StripedCounter{cells: make([]counterCell, runtime.GOMAXPROCS(0))}
+	c.pool.New = func() interface{} {
+		// Cells are handed out round robin and never freed, so a cell
+		// dropped by the pool keeps its value and may be shared.
+		i := atomic.AddUint32(&c.next, 1)
+		return &c.cells[int(i)%len(c.cells)]
+	}
+	return c
+}
+
+func (c *StripedCounter) Add(n int64) {
+	cell := c.pool.Get().(*counterCell)
+	atomic.AddInt64(&cell.v, n)
+	c.pool.Put(cell)
+}
+
+func (c *StripedCounter) Increment() {
+	c.Add(1)
+}
+
+func (c *StripedCounter) Decrement() {
+	c.Add(-1)
+}
+
+// Get returns the sum of the cells. Increments running concurrently may or
+// may not be included.
+func (c *StripedCounter) Get() int64 {
+	var sum int64
+	for i := range c.cells {
+		sum += atomic.LoadInt64(&c.cells[i].v)
+	}
+	return sum
+}
+
+// Reset sets the counter to zero and returns the value it had.
+func (c *StripedCounter) Reset() int64 {
+	var sum int64
+	for i := range c.cells {
+		sum += atomic.SwapInt64(&c.cells[i].v, 0)
+	}
+	return sum
+}
@@ -0,0 +1,532 @@
+package goutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Probabilistic counterparts of StringSet and Uint64Counter for streams too
+// large to hold exactly. Items are hashed with FNV-1a, passed through a
+// finalizer so that every bit of the hash is usable. All three structures are
+// safe for concurrent use, can be merged with another instance of the same
+// size and round-trip through MarshalBinary/UnmarshalBinary.
+
+var (
+	errSketchMismatch = errors.New("goutil: cannot merge sketches of different sizes")
+	errSketchCorrupt  = errors.New("goutil: corrupt sketch encoding")
+)
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func fnvBytes(b []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return mix64(h)
+}
+
+func fnvString(s string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return mix64(h)
+}
+
+func fnvUint64(v uint64) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= fnvPrime64
+		v >>= 8
+	}
+	return mix64(h)
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// probe derives the i-th index below n from one hash by double hashing.
+func probe(h uint64, i, n uint64) uint64 {
+	h1, h2 := h, bits.RotateLeft64(h, 32)|1
+	return (h1 + i*h2) % n
+}
+
+type sketchReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sketchReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errSketchCorrupt
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// BloomFilter tests set membership with false positives but no false
+// negatives. The zero value has no bits and holds nothing: create filters with
+// NewBloomFilter, or decode one with UnmarshalBinary.
+type BloomFilter struct {
+	// Held for reading by every operation, for writing by UnmarshalBinary,
+	// which resizes the filter. The bits themselves are updated atomically.
+	mu   sync.RWMutex
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // hashes per item
+}
+
+// NewBloomFilter returns a filter sized to keep the false-positive rate at
+// about fpRate once expected items are added.
+func NewBloomFilter(expected uint64, fpRate float64) *BloomFilter {
+	if expected < 1 {
+		expected = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(expected) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(expected) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return newBloomFilter(m, k)
+}
+
+func newBloomFilter(m, k uint64) *BloomFilter {
+	words := (m + 63) / 64
+	return &BloomFilter{bits: make([]uint64, words), m: words * 64, k: k}
+}
+
+func (f *BloomFilter) add(h uint64) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := probe(h, i, f.m)
+		w, mask := &f.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(w)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(w, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+func (f *BloomFilter) has(h uint64) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.m == 0 {
+		return false
+	}
+	for i := uint64(0); i < f.k; i++ {
+		bit := probe(h, i, f.m)
+		if atomic.LoadUint64(&f.bits[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	f.add(fnvBytes(data))
+}
+
+func (f *BloomFilter) AddString(s string) {
+	f.add(fnvString(s))
+}
+
+func (f *BloomFilter) AddUint64(v uint64) {
+	f.add(fnvUint64(v))
+}
+
+func (f *BloomFilter) Has(data []byte) bool {
+	return f.has(fnvBytes(data))
+}
+
+func (f *BloomFilter) HasString(s string) bool {
+	return f.has(fnvString(s))
+}
+
+func (f *BloomFilter) HasUint64(v uint64) bool {
+	return f.has(fnvUint64(v))
+}
+
+// EstimatedCount estimates the number of distinct items added from the
+// fraction of bits set.
+func (f *BloomFilter) EstimatedCount() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.m == 0 {
+		return 0
+	}
+	set := 0
+	for i := range f.bits {
+		set += bits.OnesCount64(atomic.LoadUint64(&f.bits[i]))
+	}
+	if uint64(set) == f.m {
+		return math.MaxUint64
+	}
+	m := float64(f.m)
+	return uint64(math.Round(-m / float64(f.k) * math.Log(1-float64(set)/m)))
+}
+
+// Merge adds the items of o, which must have the same size.
+func (f *BloomFilter) Merge(o *BloomFilter) error {
+	m, k, words := o.snapshot()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.m != m || f.k != k {
+		return errSketchMismatch
+	}
+	for i, add := range words {
+		for {
+			old := atomic.LoadUint64(&f.bits[i])
+			if old|add == old || atomic.CompareAndSwapUint64(&f.bits[i], old, old|add) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (f *BloomFilter) snapshot() (m, k uint64, words []uint64) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	words = make([]uint64, len(f.bits))
+	for i := range f.bits {
+		words[i] = atomic.LoadUint64(&f.bits[i])
+	}
+	return f.m, f.k, words
+}
+
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	m, k, words := f.snapshot()
+	out := appendUvarint(nil, m)
+	out = appendUvarint(out, k)
+	for _, w := range words {
+		out = append(out, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(out[len(out)-8:], w)
+	}
+	return out, nil
+}
+
+func (f *BloomFilter) UnmarshalBinary(data []byte) error {
+	r := &sketchReader{data: data}
+	m, k := r.uvarint(), r.uvarint()
+	if r.err == nil && (m == 0 || m%64 != 0 || k == 0 || uint64(len(r.data)) != m/8) {
+		r.err = errSketchCorrupt
+	}
+	if r.err != nil {
+		return r.err
+	}
+	words := make([]uint64, m/64)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(r.data[i*8:])
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bits, f.m, f.k = words, m, k
+	return nil
+}
+
+// CountMinSketch estimates item frequencies. Estimates never undercount, and
+// overcount by more than epsilon times the total count with probability at
+// most delta. The zero value has no counters and counts nothing: create
+// sketches with NewCountMinSketch, or decode one with UnmarshalBinary.
+type CountMinSketch struct {
+	total uint64 // first for 64-bit alignment of atomic access
+	// Held for reading by every operation, for writing by UnmarshalBinary,
+	// which resizes the sketch. The counters themselves are updated atomically.
+	mu     sync.RWMutex
+	counts []uint64 // depth rows of width counters
+	width  uint64
+	depth  uint64
+}
+
+func NewCountMinSketch(epsilon, delta float64) *CountMinSketch {
+	if epsilon <= 0 {
+		epsilon = 0.001
+	}
+	if delta <= 0 || delta >= 1 {
+		delta = 0.01
+	}
+	width := uint64(math.Ceil(math.E / epsilon))
+	depth := uint64(math.Ceil(math.Log(1 / delta)))
+	return newCountMinSketch(width, depth)
+}
+
+func newCountMinSketch(width, depth uint64) *CountMinSketch {
+	return &CountMinSketch{counts: make([]uint64, width*depth), width: width, depth: depth}
+}
+
+func (s *CountMinSketch) add(h, n uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.depth == 0 {
+		return
+	}
+	for i := uint64(0); i < s.depth; i++ {
+		atomic.AddUint64(&s.counts[i*s.width+probe(h, i, s.width)], n)
+	}
+	atomic.AddUint64(&s.total, n)
+}
+
+func (s *CountMinSketch) count(h uint64) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.depth == 0 {
+		return 0
+	}
+	min := uint64(math.MaxUint64)
+	for i := uint64(0); i < s.depth; i++ {
+		if c := atomic.LoadUint64(&s.counts[i*s.width+probe(h, i, s.width)]); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (s *CountMinSketch) Add(data []byte, n uint64) {
+	s.add(fnvBytes(data), n)
+}
+
+func (s *CountMinSketch) AddString(str string, n uint64) {
+	s.add(fnvString(str), n)
+}
+
+func (s *CountMinSketch) AddUint64(v, n uint64) {
+	s.add(fnvUint64(v), n)
+}
+
+func (s *CountMinSketch) Count(data []byte) uint64 {
+	return s.count(fnvBytes(data))
+}
+
+func (s *CountMinSketch) CountString(str string) uint64 {
+	return s.count(fnvString(str))
+}
+
+func (s *CountMinSketch) CountUint64(v uint64) uint64 {
+	return s.count(fnvUint64(v))
+}
+
+// Total returns the sum of all counts added.
+func (s *CountMinSketch) Total() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return atomic.LoadUint64(&s.total)
+}
+
+// Merge adds the counts of o, which must have the same size.
+func (s *CountMinSketch) Merge(o *CountMinSketch) error {
+	width, depth, total, counts := o.snapshot()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.width != width || s.depth != depth {
+		return errSketchMismatch
+	}
+	for i, c := range counts {
+		if c != 0 {
+			atomic.AddUint64(&s.counts[i], c)
+		}
+	}
+	atomic.AddUint64(&s.total, total)
+	return nil
+}
+
+func (s *CountMinSketch) snapshot() (width, depth, total uint64, counts []uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts = make([]uint64, len(s.counts))
+	for i := range s.counts {
+		counts[i] = atomic.LoadUint64(&s.counts[i])
+	}
+	return s.width, s.depth, atomic.LoadUint64(&s.total), counts
+}
+
+// MarshalBinary encodes the counters as uvarints, which keeps sparse sketches
+// small.
+func (s *CountMinSketch) MarshalBinary() ([]byte, error) {
+	width, depth, total, counts := s.snapshot()
+	out := appendUvarint(nil, width)
+	out = appendUvarint(out, depth)
+	out = appendUvarint(out, total)
+	for _, c := range counts {
+		out = appendUvarint(out, c)
+	}
+	return out, nil
+}
+
+func (s *CountMinSketch) UnmarshalBinary(data []byte) error {
+	r := &sketchReader{data: data}
+	width, depth, total := r.uvarint(), r.uvarint(), r.uvarint()
+	// every counter takes at least a byte
+	if r.err == nil && (width == 0 || depth == 0 || width > uint64(len(r.data))/depth) {
+		r.err = errSketchCorrupt
+	}
+	if r.err != nil {
+		return r.err
+	}
+	counts := make([]uint64, width*depth)
+	for i := range counts {
+		counts[i] = r.uvarint()
+	}
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errSketchCorrupt
+	}
+	if r.err != nil {
+		return r.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts, s.width, s.depth = counts, width, depth
+	atomic.StoreUint64(&s.total, total)
+	return nil
+}
+
+// HyperLogLog estimates the number of distinct items added, with a standard
+// error of about 1.04/sqrt(2^precision) using 2^precision bytes.
+type HyperLogLog struct {
+	mu        sync.RWMutex
+	registers []uint8
+	p         uint8
+}
+
+// NewHyperLogLog returns a HyperLogLog with the given precision between 4 and
+// 18; 14 gives about 0.8% error in 16KB.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 {
+		precision = 4
+	}
+	if precision > 18 {
+		precision = 18
+	}
+	return &HyperLogLog{registers: make([]uint8, 1<<precision), p: precision}
+}
+
+// position returns the register for hash x and the rank it records there.
+// Must be called with h.mu held, since UnmarshalBinary can change p.
+func (h *HyperLogLog) position(x uint64) (idx uint64, rho uint8) {
+	return x >> (64 - h.p), uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1))) + 1
+}
+
+func (h *HyperLogLog) add(x uint64) {
+	h.mu.RLock()
+	idx, rho := h.position(x)
+	cur := h.registers[idx]
+	h.mu.RUnlock()
+	if rho <= cur {
+		return
+	}
+	h.mu.Lock()
+	idx, rho = h.position(x)
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+	h.mu.Unlock()
+}
+
+func (h *HyperLogLog) Add(data []byte) {
+	h.add(fnvBytes(data))
+}
+
+func (h *HyperLogLog) AddString(s string) {
+	h.add(fnvString(s))
+}
+
+func (h *HyperLogLog) AddUint64(v uint64) {
+	h.add(fnvUint64(v))
+}
+
+// Count estimates the number of distinct items added.
+func (h *HyperLogLog) Count() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Merge adds the items of o, which must have the same precision.
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	p, regs := o.snapshot()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.p != p {
+		return errSketchMismatch
+	}
+	for i, r := range regs {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (h *HyperLogLog) snapshot() (uint8, []uint8) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.p, append([]uint8(nil), h.registers...)
+}
+
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	p, regs := h.snapshot()
+	return append([]byte{p}, regs...), nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] < 4 || data[0] > 18 || len(data)-1 != 1<<data[0] {
+		return errSketchCorrupt
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.p = data[0]
+	h.registers = append([]uint8(nil), data[1:]...)
+	return nil
+}
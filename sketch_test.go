@@ -0,0 +1,161 @@
+package goutil
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := NewBloomFilter(10000, 0.01)
+	for i := uint64(0); i < 10000; i++ {
+		f.AddUint64(i)
+	}
+	fp := 0
+	for i := uint64(0); i < 10000; i++ {
+		if !f.HasUint64(i) {
+			t.Fatalf("false negative for %d", i)
+		}
+		if f.HasUint64(i + 1e9) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 10000; rate > 0.02 {
+		t.Errorf("false-positive rate %v, want about 0.01", rate)
+	}
+
+	g := NewBloomFilter(10000, 0.01)
+	g.AddString("x")
+	if err := f.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := f.MarshalBinary()
+	var h BloomFilter
+	if err := h.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !h.HasString("x") || !h.HasUint64(1234) {
+		t.Error("merged and decoded filter lost items")
+	}
+	if err := f.Merge(NewBloomFilter(10, 0.01)); err == nil {
+		t.Error("merged filters of different sizes")
+	}
+
+	var zero BloomFilter
+	zero.AddString("x")
+	if zero.HasString("x") || zero.EstimatedCount() != 0 {
+		t.Error("zero value filter holds items")
+	}
+
+	// Run with -race: decoding a different size while adding.
+	small, _ := NewBloomFilter(10, 0.01).MarshalBinary()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(0); i < 1000; i++ {
+			h.AddUint64(i)
+			h.HasUint64(i)
+		}
+	}()
+	if err := h.UnmarshalBinary(small); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(0.001, 0.01)
+	for i := uint64(0); i < 1000; i++ {
+		s.AddUint64(i, i)
+	}
+	bound := uint64(0.001 * float64(s.Total()))
+	for i := uint64(0); i < 1000; i += 37 {
+		if c := s.CountUint64(i); c < i || c > i+bound {
+			t.Errorf("count of %d is %d, want within [%d, %d]", i, c, i, i+bound)
+		}
+	}
+	data, _ := s.MarshalBinary()
+	var d CountMinSketch
+	if err := d.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Merge(s); err != nil {
+		t.Fatal(err)
+	}
+	if d.Total() != 2*s.Total() || d.CountUint64(500) < 1000 {
+		t.Errorf("merge of decoded sketch: total %d, count %d", d.Total(), d.CountUint64(500))
+	}
+
+	// width*depth wraps around to zero
+	bad := appendUvarint(appendUvarint(appendUvarint(nil, 1<<32), 1<<32), 0)
+	if err := d.UnmarshalBinary(append(bad, 0)); err == nil {
+		t.Error("decoded a sketch with an overflowing size")
+	}
+
+	var zero CountMinSketch
+	zero.AddString("x", 1)
+	if zero.CountString("x") != 0 || zero.Total() != 0 {
+		t.Error("zero value sketch counts items")
+	}
+
+	// Run with -race: decoding a different size while adding.
+	small, _ := NewCountMinSketch(0.5, 0.5).MarshalBinary()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(0); i < 1000; i++ {
+			d.AddUint64(i, 1)
+			d.CountUint64(i)
+		}
+	}()
+	if err := d.UnmarshalBinary(small); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestHyperLogLog(t *testing.T) {
+	a, b := NewHyperLogLog(14), NewHyperLogLog(14)
+	for i := uint64(0); i < 100000; i++ {
+		a.AddUint64(i)
+		b.AddUint64(i + 50000)
+	}
+	if n := a.Count(); math.Abs(float64(n)-1e5) > 3e3 {
+		t.Errorf("count %d, want about 100000", n)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := a.MarshalBinary()
+	var c HyperLogLog
+	if err := c.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Count(); math.Abs(float64(n)-1.5e5) > 4.5e3 {
+		t.Errorf("merged count %d, want about 150000", n)
+	}
+	small := NewHyperLogLog(14)
+	for i := 0; i < 10; i++ {
+		small.AddString("same")
+	}
+	if n := small.Count(); n != 1 {
+		t.Errorf("count of one repeated item is %d", n)
+	}
+
+	// Run with -race: decoding a different precision while adding.
+	low, _ := NewHyperLogLog(4).MarshalBinary()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(0); i < 1000; i++ {
+			c.AddUint64(i)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		c.UnmarshalBinary(low)
+		c.UnmarshalBinary(data)
+	}
+	<-done
+	if err := c.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@ package goutil
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sync"
 	"sync/atomic"
@@ -34,16 +35,140 @@ func NewTimeoutMutex(timeout time.Duration) TimeoutMutex {
 	}
 }
 
+func (m TimeoutMutex) debugName() string {
+	return fmt.Sprintf("TimeoutMutex@%p", m.l)
+}
+
 func (m TimeoutMutex) Lock() error {
 	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
 	defer cancel()
-	return m.l.Acquire(ctx, 1)
+	if !LockDebugEnabled() {
+		return m.l.Acquire(ctx, 1)
+	}
+	debugLockWait(m.debugName())
+	err := m.l.Acquire(ctx, 1)
+	if err == nil {
+		debugLocked(m.debugName(), true)
+	}
+	return err
 }
 
 func (m TimeoutMutex) Unlock() {
+	if LockDebugEnabled() {
+		debugUnlocked(m.debugName(), true)
+	}
 	m.l.Release(1)
 }
 
+// TimeoutRWMutex is a reader/writer lock whose acquisitions can be bounded by a
+// context or timeout. Waiters are served in arrival order, so a waiting writer
+// blocks later readers and is not starved. Unlocking a lock that is not held
+// returns ErrNotLocked instead of panicking. The zero value is an unlocked
+// mutex without a default timeout.
+type TimeoutRWMutex struct {
+	// A single-key shard provides the waiter queue of KeyedMutex.
+	s       keyedShard[struct{}]
+	timeout time.Duration
+}
+
+// NewTimeoutRWMutex returns a TimeoutRWMutex whose Lock and RLock give up
+// after timeout; zero or NO_TIMEOUT waits forever.
+func NewTimeoutRWMutex(timeout time.Duration) *TimeoutRWMutex {
+	return &TimeoutRWMutex{timeout: timeout}
+}
+
+func (m *TimeoutRWMutex) debugName() string {
+	return fmt.Sprintf("TimeoutRWMutex@%p", m)
+}
+
+func (m *TimeoutRWMutex) lock(ctx context.Context, write bool) error {
+	if !LockDebugEnabled() {
+		return m.s.lock(ctx, struct{}{}, write)
+	}
+	debugLockWait(m.debugName())
+	err := m.s.lock(ctx, struct{}{}, write)
+	if err == nil {
+		debugLocked(m.debugName(), write)
+	}
+	return err
+}
+
+func (m *TimeoutRWMutex) lockTimeout(timeout time.Duration, write bool) error {
+	if timeout <= 0 || timeout == NO_TIMEOUT {
+		return m.lock(nil, write)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.lock(ctx, write)
+}
+
+func (m *TimeoutRWMutex) tryLock(write bool) bool {
+	ok := m.s.tryLock(struct{}{}, write)
+	if ok && LockDebugEnabled() {
+		debugLocked(m.debugName(), write)
+	}
+	return ok
+}
+
+func (m *TimeoutRWMutex) unlock(write bool) error {
+	// record the release first, as KeyedMutex does, so a goroutine locking m
+	// right after is never listed next to the old holder; an unlocked m has no
+	// holders to remove
+	if LockDebugEnabled() {
+		debugUnlocked(m.debugName(), write)
+	}
+	if !m.s.tryUnlock(struct{}{}, write) {
+		return ErrNotLocked
+	}
+	return nil
+}
+
+// Lock locks m, waiting at most the timeout m was created with.
+func (m *TimeoutRWMutex) Lock() error {
+	return m.lockTimeout(m.timeout, true)
+}
+
+// RLock read-locks m, waiting at most the timeout m was created with.
+func (m *TimeoutRWMutex) RLock() error {
+	return m.lockTimeout(m.timeout, false)
+}
+
+func (m *TimeoutRWMutex) LockTimeout(timeout time.Duration) error {
+	return m.lockTimeout(timeout, true)
+}
+
+func (m *TimeoutRWMutex) RLockTimeout(timeout time.Duration) error {
+	return m.lockTimeout(timeout, false)
+}
+
+// LockContext locks m, giving up with ctx.Err() once ctx is done.
+func (m *TimeoutRWMutex) LockContext(ctx context.Context) error {
+	return m.lock(ctx, true)
+}
+
+// RLockContext read-locks m, giving up with ctx.Err() once ctx is done.
+func (m *TimeoutRWMutex) RLockContext(ctx context.Context) error {
+	return m.lock(ctx, false)
+}
+
+// TryLock locks m only if it is free right away.
+func (m *TimeoutRWMutex) TryLock() bool {
+	return m.tryLock(true)
+}
+
+// TryRLock read-locks m only if it can be shared right away.
+func (m *TimeoutRWMutex) TryRLock() bool {
+	return m.tryLock(false)
+}
+
+func (m *TimeoutRWMutex) Unlock() error {
+	return m.unlock(true)
+}
+
+func (m *TimeoutRWMutex) RUnlock() error {
+	return m.unlock(false)
+}
+
 type ConcurrentIdIdxMap struct {
 	Data map[uint64]int
 	Mu   sync.RWMutex
@@ -89,18 +214,57 @@ func (m *ConcurrentIdIdxMap) SetData(data map[uint64]int) {
 	m.Data = data
 }
 
-// type Locker interface {
-// 	Lock()
-// }
-
-// type RLocker interface {
-// 	Lock()
-// }
-
-// func LockWithTimeout(m Locker, timeout time.Duration) error {
+// RLocker is implemented by reader/writer locks such as sync.RWMutex.
+type RLocker interface {
+	RLock()
+	RUnlock()
+}
 
-// }
+// LockWithTimeout locks l, giving up with context.DeadlineExceeded after
+// timeout. Since l.Lock cannot be interrupted, a timed-out call leaves a
+// goroutine waiting for l, which unlocks it again as soon as it gets it.
+func LockWithTimeout(l sync.Locker, timeout time.Duration) error {
+	if t, ok := l.(interface{ TryLock() bool }); ok && t.TryLock() {
+		return nil
+	}
+	return lockWithTimeout(l.Lock, l.Unlock, timeout)
+}
 
-// func RLockWithTimeout(m RLocker, timeout time.Duration) {
+// RLockWithTimeout is LockWithTimeout for a read lock.
+func RLockWithTimeout(l RLocker, timeout time.Duration) error {
+	if t, ok := l.(interface{ TryRLock() bool }); ok && t.TryRLock() {
+		return nil
+	}
+	return lockWithTimeout(l.RLock, l.RUnlock, timeout)
+}
 
-// }
+func lockWithTimeout(lock, unlock func(), timeout time.Duration) error {
+	const (
+		waiting int32 = iota
+		acquired
+		abandoned
+	)
+	var state int32
+	done := make(chan struct{})
+	go func() {
+		lock()
+		if atomic.CompareAndSwapInt32(&state, waiting, acquired) {
+			close(done)
+		} else {
+			unlock()
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+	if atomic.CompareAndSwapInt32(&state, waiting, abandoned) {
+		return context.DeadlineExceeded
+	}
+	// acquired just as the timer fired
+	<-done
+	return nil
+}
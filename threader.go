@@ -1,14 +1,55 @@
 package goutil
 
 import (
+	"container/list"
+	"context"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
 )
 
+// Threader limits the number of threads running at once. A Threader built as a
+// struct literal rather than with NewThreader works, but has aging disabled
+// and does not record wait times.
 type Threader struct {
 	RunningCond sync.Cond
 	Running     int64
 	NumThreads  int64
+
+	// guarded by RunningCond.L
+	queues     map[Priority]*list.List // of *threadWaiter, in arrival order
+	aging      time.Duration
+	holders    int64
+	waiting    int64
+	acquired   uint64
+	released   uint64
+	busy       time.Duration // integral of holders over time
+	lastChange time.Time
+	waitHist   *Histogram
+	adaptive   chan struct{}
+}
+
+// Priority orders queued acquisitions; higher values are admitted first.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// DefaultAgingInterval is how long a queued acquisition waits to be treated
+// as one priority class higher.
+const DefaultAgingInterval = 100 * time.Millisecond
+
+type threadWaiter struct {
+	weight   int64
+	priority Priority
+	since    time.Time
+	granted  bool
+	ready    chan struct{}
 }
 
 func NewThreader(numThreads int) *Threader {
@@ -16,33 +57,217 @@ func NewThreader(numThreads int) *Threader {
 		RunningCond: sync.Cond{L: &sync.Mutex{}},
 		Running:     0,
 		NumThreads:  int64(numThreads),
+		queues:      make(map[Priority]*list.List),
+		aging:       DefaultAgingInterval,
+		waitHist:    NewHistogram(),
 	}
 }
 
-func (t *Threader) Acquire() {
+// SetAgingInterval sets how long a queued acquisition waits to be treated as
+// one priority class higher, so low priority work is admitted eventually even
+// under a steady stream of high priority work. Zero disables aging.
+func (t *Threader) SetAgingInterval(d time.Duration) {
 	t.RunningCond.L.Lock()
-	for t.Running == atomic.LoadInt64(&t.NumThreads) {
-		t.RunningCond.Wait()
+	t.aging = d
+	t.RunningCond.L.Unlock()
+}
+
+// account must be called with RunningCond.L held before holders changes.
+func (t *Threader) account(now time.Time) {
+	if !t.lastChange.IsZero() {
+		t.busy += time.Duration(t.holders) * now.Sub(t.lastChange)
+	}
+	t.lastChange = now
+}
+
+// fits reports whether weight threads can be taken now. A weight larger than
+// the thread count is admitted once nothing else runs, unless the thread
+// count is zero, which pauses the threader.
+func (t *Threader) fits(weight int64) bool {
+	n := atomic.LoadInt64(&t.NumThreads)
+	return t.Running+weight <= n || (t.Running == 0 && n > 0)
+}
+
+func (t *Threader) take(weight int64, now time.Time) {
+	t.account(now)
+	t.Running += weight
+	t.holders++
+	t.acquired++
+}
+
+// next returns the queue head to admit next: the one with the highest
+// priority after aging, the oldest among equals.
+func (t *Threader) next(now time.Time) *list.Element {
+	var best *list.Element
+	var bestPrio float64
+	for _, q := range t.queues {
+		el := q.Front()
+		w := el.Value.(*threadWaiter)
+		prio := float64(w.priority)
+		if t.aging > 0 {
+			prio += float64(now.Sub(w.since)) / float64(t.aging)
+		}
+		if best == nil || prio > bestPrio || (prio == bestPrio && w.since.Before(best.Value.(*threadWaiter).since)) {
+			best, bestPrio = el, prio
+		}
+	}
+	return best
+}
+
+// dispatch admits queued acquisitions in order until the next one does not
+// fit; later, smaller ones do not overtake it. Must be called with
+// RunningCond.L held.
+func (t *Threader) dispatch() {
+	now := time.Now()
+	for {
+		el := t.next(now)
+		if el == nil {
+			return
+		}
+		w := el.Value.(*threadWaiter)
+		if !t.fits(w.weight) {
+			return
+		}
+		t.dequeue(el)
+		t.take(w.weight, now)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+func (t *Threader) dequeue(el *list.Element) {
+	w := el.Value.(*threadWaiter)
+	q := t.queues[w.priority]
+	q.Remove(el)
+	if q.Len() == 0 {
+		delete(t.queues, w.priority)
+	}
+	t.waiting--
+}
+
+// AcquirePriority takes weight threads, queueing behind acquisitions of
+// higher or equal priority, and gives up with ctx.Err() once ctx is done. A
+// nil ctx waits forever. A weight below 1 returns ErrBadWeight.
+func (t *Threader) AcquirePriority(ctx context.Context, priority Priority, weight int64) error {
+	if weight < 1 {
+		return ErrBadWeight
+	}
+	if ctx != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	start := time.Now()
+	t.RunningCond.L.Lock()
+	if t.waiting == 0 && t.fits(weight) {
+		t.take(weight, start)
+		t.RunningCond.L.Unlock()
+		t.waitHist.Record(0)
+		return nil
+	}
+	if t.queues == nil {
+		t.queues = make(map[Priority]*list.List)
 	}
-	t.Running++
+	q := t.queues[priority]
+	if q == nil {
+		q = list.New()
+		t.queues[priority] = q
+	}
+	w := &threadWaiter{weight: weight, priority: priority, since: start, ready: make(chan struct{})}
+	el := q.PushBack(w)
+	t.waiting++
 	t.RunningCond.L.Unlock()
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-w.ready:
+		t.waitHist.Record(time.Since(start))
+		return nil
+	case <-done:
+	}
+
+	t.RunningCond.L.Lock()
+	defer t.RunningCond.L.Unlock()
+	if w.granted {
+		// granted while giving up: hand the threads on
+		t.release(weight)
+	} else {
+		t.dequeue(el)
+		t.dispatch()
+	}
+	return ctx.Err()
 }
 
+func (t *Threader) Acquire() {
+	t.AcquirePriority(nil, PriorityNormal, 1)
+}
+
+// AcquireContext takes a thread, giving up with ctx.Err() once ctx is done.
+func (t *Threader) AcquireContext(ctx context.Context) error {
+	return t.AcquirePriority(ctx, PriorityNormal, 1)
+}
+
+// AcquireWeighted takes weight threads at once; release them with
+// ReleaseWeighted.
+func (t *Threader) AcquireWeighted(ctx context.Context, weight int64) error {
+	return t.AcquirePriority(ctx, PriorityNormal, weight)
+}
+
+// TryAcquireWeighted takes weight threads only if they are free and nothing
+// is queued. It panics if weight is below 1.
+func (t *Threader) TryAcquireWeighted(weight int64) bool {
+	if weight < 1 {
+		panic(ErrBadWeight)
+	}
+	t.RunningCond.L.Lock()
+	defer t.RunningCond.L.Unlock()
+	if t.waiting > 0 || !t.fits(weight) {
+		return false
+	}
+	t.take(weight, time.Now())
+	return true
+}
+
+func (t *Threader) TryAcquire() bool {
+	return t.TryAcquireWeighted(1)
+}
+
+// SetThreadCount changes the number of threads. Raising it admits waiting
+// Acquire calls right away; lowering it below Running lets no new work in
+// until enough threads are released.
 func (t *Threader) SetThreadCount(numThreads int) {
+	t.RunningCond.L.Lock()
 	atomic.StoreInt64(&t.NumThreads, int64(numThreads))
+	t.dispatch()
+	t.RunningCond.L.Unlock()
 }
 
 func (t *Threader) GetThreadCount() int {
-	return int(t.NumThreads)
+	return int(atomic.LoadInt64(&t.NumThreads))
+}
+
+// release must be called with RunningCond.L held.
+func (t *Threader) release(weight int64) {
+	t.account(time.Now())
+	t.Running -= weight
+	t.holders--
+	t.released++
+	t.dispatch()
+	t.RunningCond.Broadcast()
 }
 
 func (t *Threader) Release() {
+	t.ReleaseWeighted(1)
+}
+
+func (t *Threader) ReleaseWeighted(weight int64) {
 	t.RunningCond.L.Lock()
-	t.Running--
-	t.RunningCond.Signal()
+	t.release(weight)
 	t.RunningCond.L.Unlock()
 }
 
+// Wait waits until no threads are taken.
 func (t *Threader) Wait() {
 	t.RunningCond.L.Lock()
 	for t.Running > 0 {
@@ -50,3 +275,139 @@ func (t *Threader) Wait() {
 	}
 	t.RunningCond.L.Unlock()
 }
+
+type ThreaderStats struct {
+	NumThreads int    `json:"num_threads"`
+	Running    int    `json:"running"`
+	Waiting    int    `json:"waiting"`
+	Acquired   uint64 `json:"acquired"`
+	Released   uint64 `json:"released"`
+	// Mean time between Acquire and Release, counting threads still
+	// running up to now.
+	MeanHold time.Duration    `json:"mean_hold"`
+	Wait     HistogramSummary `json:"wait"`
+}
+
+// Stats returns counters since the Threader was created and the distribution
+// of time spent waiting in Acquire.
+func (t *Threader) Stats() ThreaderStats {
+	t.RunningCond.L.Lock()
+	defer t.RunningCond.L.Unlock()
+	t.account(time.Now())
+	s := ThreaderStats{
+		NumThreads: t.GetThreadCount(),
+		Running:    int(t.Running),
+		Waiting:    int(t.waiting),
+		Acquired:   t.acquired,
+		Released:   t.released,
+		Wait:       t.waitHist.Summary(),
+	}
+	if t.acquired > 0 {
+		s.MeanHold = t.busy / time.Duration(t.acquired)
+	}
+	return s
+}
+
+// AdaptiveOptions configures StartAdaptive. Targets left at zero are not
+// checked.
+type AdaptiveOptions struct {
+	Min, Max int
+	Interval time.Duration // defaults to a second
+	// Shrink while system CPU usage is above this percentage.
+	TargetCPU float64
+	// Shrink while the mean time between Acquire and Release is above this.
+	TargetLatency time.Duration
+}
+
+// StartAdaptive adjusts the thread count every interval: it is lowered by a
+// quarter while a target is exceeded, and raised by one while all targets are
+// met and every thread is in use. It stops a previously started adaptive mode
+// and runs until the returned function is called.
+func (t *Threader) StartAdaptive(opts AdaptiveOptions) (stop func()) {
+	if opts.Min < 1 {
+		opts.Min = 1
+	}
+	if opts.Max < opts.Min {
+		opts.Max = opts.Min
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	done := make(chan struct{})
+	t.RunningCond.L.Lock()
+	if t.adaptive != nil {
+		close(t.adaptive)
+	}
+	t.adaptive = done
+	t.RunningCond.L.Unlock()
+	if opts.TargetCPU > 0 {
+		// the first call measures since boot
+		cpu.Percent(0, false)
+	}
+	go t.adapt(opts, done)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.RunningCond.L.Lock()
+			if t.adaptive == done {
+				close(done)
+				t.adaptive = nil
+			}
+			t.RunningCond.L.Unlock()
+		})
+	}
+}
+
+func (t *Threader) adapt(opts AdaptiveOptions, done chan struct{}) {
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	t.RunningCond.L.Lock()
+	t.account(time.Now())
+	lastBusy, lastReleased := t.busy, t.released
+	t.RunningCond.L.Unlock()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		over := false
+		if opts.TargetCPU > 0 {
+			if p, err := cpu.Percent(0, false); err == nil && len(p) > 0 && p[0] > opts.TargetCPU {
+				over = true
+			}
+		}
+
+		t.RunningCond.L.Lock()
+		t.account(time.Now())
+		busy, released := t.busy-lastBusy, t.released-lastReleased
+		lastBusy, lastReleased = t.busy, t.released
+		// By Little's law the mean latency is the mean number of running
+		// threads over the completion rate.
+		if opts.TargetLatency > 0 && released > 0 && busy/time.Duration(released) > opts.TargetLatency {
+			over = true
+		}
+		n := int(atomic.LoadInt64(&t.NumThreads))
+		saturated := t.Running >= int64(n) && t.waiting > 0
+		t.RunningCond.L.Unlock()
+
+		switch {
+		case over:
+			n -= (n + 3) / 4
+		case saturated:
+			n++
+		default:
+			continue
+		}
+		if n < opts.Min {
+			n = opts.Min
+		}
+		if n > opts.Max {
+			n = opts.Max
+		}
+		if n != t.GetThreadCount() {
+			t.SetThreadCount(n)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package goutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(context.Background(), 3)
+	var running, maxRunning int64
+	for i := 0; i < 20; i++ {
+		p.Go(func(ctx context.Context) error {
+			n := atomic.AddInt64(&running, 1)
+			for {
+				m := atomic.LoadInt64(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			return nil
+		})
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning > 3 {
+		t.Errorf("%d tasks ran at once, limit is 3", maxRunning)
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	errFail := errors.New("fail")
+	p := NewPool(context.Background(), 1)
+	var ran int64
+	started, fail := make(chan struct{}), make(chan struct{})
+	p.Go(func(ctx context.Context) error {
+		close(started)
+		<-fail
+		return errFail
+	})
+	<-started
+	for i := 0; i < 10; i++ {
+		p.Go(func(ctx context.Context) error {
+			atomic.AddInt64(&ran, 1)
+			return nil
+		})
+	}
+	close(fail)
+	if err := p.Wait(); err != errFail {
+		t.Fatalf("Wait returned %v, want %v", err, errFail)
+	}
+	if ran != 0 {
+		t.Errorf("%d queued tasks ran after the failure", ran)
+	}
+
+	p = NewPool(context.Background(), 2).ContinueOnError()
+	p.Go(func(ctx context.Context) error { return errFail })
+	p.Go(func(ctx context.Context) error { panic("boom") })
+	p.Go(func(ctx context.Context) error { return nil })
+	p.Wait()
+	errs := p.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("got %d errors, want 2: %v", len(errs), errs)
+	}
+	var pe *PanicError
+	if !errors.As(errs[0], &pe) && !errors.As(errs[1], &pe) {
+		t.Errorf("panic not reported as PanicError: %v", errs)
+	}
+}
+
+func TestThreaderSetThreadCount(t *testing.T) {
+	th := NewThreader(1)
+	th.Acquire()
+	acquired := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			th.Acquire()
+			acquired <- struct{}{}
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	th.SetThreadCount(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatal("raising the thread count did not wake waiters")
+		}
+	}
+
+	// lowering below Running blocks new work until enough are released
+	th.SetThreadCount(1)
+	go func() {
+		th.Acquire()
+		acquired <- struct{}{}
+	}()
+	th.Release()
+	th.Release()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire succeeded with Running at the limit")
+	case <-time.After(5 * time.Millisecond):
+	}
+	th.Release()
+	<-acquired
+	th.Release()
+
+	s := th.Stats()
+	if s.Acquired != 4 || s.Released != 4 || s.Running != 0 || s.Waiting != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// a zero thread count pauses the threader even when nothing runs
+	th.SetThreadCount(0)
+	if th.TryAcquire() {
+		t.Fatal("TryAcquire succeeded with a zero thread count")
+	}
+	th.SetThreadCount(1)
+	if !th.TryAcquire() {
+		t.Fatal("TryAcquire failed after resuming")
+	}
+	th.Release()
+}
+
+func TestThreaderStructLiteral(t *testing.T) {
+	th := &Threader{RunningCond: sync.Cond{L: &sync.Mutex{}}, NumThreads: 1}
+	th.Acquire()
+	acquired := make(chan struct{})
+	go func() {
+		th.Acquire()
+		close(acquired)
+	}()
+	time.Sleep(5 * time.Millisecond) // let it queue
+	th.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("queued Acquire was not admitted")
+	}
+	th.Release()
+	th.Wait()
+	if s := th.Stats(); s.Acquired != 2 || s.Released != 2 || s.Wait.Count != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestThreaderAdaptive(t *testing.T) {
+	th := NewThreader(1)
+	stop := th.StartAdaptive(AdaptiveOptions{Min: 1, Max: 4, Interval: 2 * time.Millisecond, TargetLatency: time.Hour})
+	defer stop()
+	p := NewPoolWithThreader(context.Background(), th)
+	for i := 0; i < 200; i++ {
+		p.Go(func(ctx context.Context) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	p.Wait()
+	if n := th.GetThreadCount(); n < 2 {
+		t.Errorf("thread count stayed at %d with a saturated queue", n)
+	}
+}
+
+func TestThreaderPriority(t *testing.T) {
+	order := func(th *Threader, pause time.Duration) []Priority {
+		th.Acquire()
+		var got []Priority
+		done := make(chan Priority)
+		for i, p := range []Priority{PriorityLow, PriorityHigh} {
+			go func(p Priority) {
+				th.AcquirePriority(nil, p, 1)
+				done <- p
+				th.Release()
+			}(p)
+			for th.Stats().Waiting != i+1 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(pause)
+		}
+		th.Release()
+		got = append(got, <-done, <-done)
+		return got
+	}
+	if got := order(NewThreader(1), 0); got[0] != PriorityHigh {
+		t.Errorf("admitted in order %v, want high priority first", got)
+	}
+	th := NewThreader(1)
+	th.SetAgingInterval(time.Millisecond)
+	if got := order(th, 10*time.Millisecond); got[0] != PriorityLow {
+		t.Errorf("admitted in order %v, want the aged low priority first", got)
+	}
+}
+
+func TestThreaderWeighted(t *testing.T) {
+	th := NewThreader(4)
+	if err := th.AcquireWeighted(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if th.TryAcquireWeighted(2) {
+		t.Fatal("TryAcquireWeighted exceeded the thread count")
+	}
+	if !th.TryAcquire() {
+		t.Fatal("TryAcquire failed with a thread free")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := th.AcquireContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("AcquireContext returned %v", err)
+	}
+	th.Release()
+	th.ReleaseWeighted(3)
+	// more than the thread count is admitted once nothing else runs
+	if !th.TryAcquireWeighted(8) {
+		t.Fatal("oversized acquisition of an idle Threader failed")
+	}
+	th.ReleaseWeighted(8)
+	if s := th.Stats(); s.Running != 0 || s.Waiting != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	for _, w := range []int64{0, -1} {
+		if err := th.AcquireWeighted(context.Background(), w); err != ErrBadWeight {
+			t.Errorf("AcquireWeighted(%d) returned %v", w, err)
+		}
+		if err := th.AcquirePriority(nil, PriorityHigh, w); err != ErrBadWeight {
+			t.Errorf("AcquirePriority with weight %d returned %v", w, err)
+		}
+		func() {
+			defer func() {
+				if recover() != ErrBadWeight {
+					t.Errorf("TryAcquireWeighted(%d) did not panic", w)
+				}
+			}()
+			th.TryAcquireWeighted(w)
+		}()
+	}
+	if s := th.Stats(); s.Running != 0 || s.Acquired != 3 {
+		t.Errorf("bad weights changed the stats: %+v", s)
+	}
+}
@@ -1,10 +1,13 @@
 package goutil
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 type OpTrace struct {
@@ -12,12 +15,22 @@ type OpTrace struct {
 	Duration time.Duration `json:"duration"`
 	Children []*OpTrace    `json:"children,omitempty"`
 	Count    int64         `json:"count,omitempty"`
-	start    time.Time
-	lock     *sync.RWMutex
+	// Set by EnableHistograms, atomically; nil when only totals are kept.
+	// Read it with GetHistogram while the trace is in use.
+	Histogram *Histogram `json:"histogram,omitempty"`
+	start     int64      // unix nanos, set on creation and reset
+	lock      *sync.RWMutex
+}
+
+// OpTimer times one invocation of an operation. Timers are independent, so
+// any number of goroutines can time the same node at once.
+type OpTimer struct {
+	node  *OpTrace
+	start time.Time
 }
 
 func NewOpTrace(fname string) *OpTrace {
-	return &OpTrace{Function: fname, start: time.Now(), lock: &sync.RWMutex{}}
+	return &OpTrace{Function: fname, start: time.Now().UnixNano(), lock: &sync.RWMutex{}}
 }
 
 func ident(lvl int) string {
@@ -28,7 +41,10 @@ func ident(lvl int) string {
 	return tabs
 }
 
-func (l OpTrace) getString(lvl int) string {
+func (l *OpTrace) getString(lvl int) string {
+	if l == nil {
+		return "<nil>"
+	}
 	// if l.Duration == 0 {
 	// 	l.CalcDuration()
 	// }
@@ -37,31 +53,50 @@ func (l OpTrace) getString(lvl int) string {
 	if count > 0 {
 		msg += fmt.Sprintf(", count: %d", count)
 	}
+	if h := l.GetHistogram(); h.Count() > 0 {
+		msg += ", " + h.String()
+	}
 	var tabs string = ident(lvl + 1)
-	for _, child := range l.Children {
+	for _, child := range l.GetChildren() {
 		msg += fmt.Sprintf("\n%s%s", tabs, child.getString(lvl+1))
 	}
 	return msg
 }
 
 func (l OpTrace) String() string {
+	return l.string()
+}
+
+// Format prints a trace like String, but through the pointer, without
+// copying the fields other goroutines may be updating.
+func (l *OpTrace) Format(f fmt.State, verb rune) {
+	io.WriteString(f, l.string())
+}
+
+func (l *OpTrace) string() string {
 	start := time.Now()
 	str := l.getString(0)
 	return fmt.Sprintf("process-trace: \n%s\ngen-string-time:%v", str, time.Now().Sub(start))
 }
 
 func (l *OpTrace) AddNewChild(fname string) *OpTrace {
+	if l == nil {
+		return NewOpTrace(fname)
+	}
 	l.lock.Lock()
 	defer l.lock.Unlock()
 	return l.addNewChild(fname)
 }
 
 func (l *OpTrace) GetOrCreateChild(fname string) (*OpTrace, time.Time) {
-	l.lock.Lock()
-	defer l.lock.Unlock()
 	if l == nil {
 		return NewOpTrace(fname), time.Now()
 	}
+	if c := l.getChild(fname); c != nil {
+		return c, time.Now()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	for _, c := range l.Children {
 		if c.Function == fname {
 			return c, time.Now()
@@ -70,7 +105,39 @@ func (l *OpTrace) GetOrCreateChild(fname string) (*OpTrace, time.Time) {
 	return l.addNewChild(fname), time.Now()
 }
 
+func (l *OpTrace) getChild(fname string) *OpTrace {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, c := range l.Children {
+		if c.Function == fname {
+			return c
+		}
+	}
+	return nil
+}
+
+// GetChildren returns a copy of the child list, safe to range over while other
+// goroutines add children.
+func (l *OpTrace) GetChildren() []*OpTrace {
+	if l == nil {
+		return nil
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if len(l.Children) == 0 {
+		return nil
+	}
+	children := make([]*OpTrace, len(l.Children))
+	copy(children, l.Children)
+	return children
+}
+
 func (l *OpTrace) AddChild(child *OpTrace) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if l.Children == nil {
 		l.Children = []*OpTrace{}
 	}
@@ -79,7 +146,11 @@ func (l *OpTrace) AddChild(child *OpTrace) {
 }
 
 func (l *OpTrace) CalcDuration() *OpTrace {
-	l.Duration = time.Now().Sub(l.start)
+	if l == nil {
+		return nil
+	}
+	dur := time.Now().UnixNano() - atomic.LoadInt64(&l.start)
+	atomic.StoreInt64((*int64)(&l.Duration), dur)
 	return l
 }
 
@@ -87,31 +158,96 @@ func (l *OpTrace) Restart() *OpTrace {
 	return l.ResetTo(time.Now())
 }
 
+// ResetTo clears the counters of l and its descendants and starts a new window
+// at start. Use Collect to also get what was counted.
 func (l *OpTrace) ResetTo(start time.Time) *OpTrace {
-	l.start = start
+	if l == nil {
+		return nil
+	}
 	atomic.StoreInt64(&l.Count, 0)
-	for _, c := range l.Children {
+	atomic.StoreInt64((*int64)(&l.Duration), 0)
+	l.GetHistogram().reset()
+	atomic.StoreInt64(&l.start, start.UnixNano())
+	for _, c := range l.GetChildren() {
 		c.ResetTo(start)
 	}
 	return l
 }
 
-// For repeating operations
-func (l *OpTrace) Start() *OpTrace {
-	l.start = time.Now()
-	atomic.AddInt64(&l.Count, 1)
-	return l
+// Collect resets the counters of l and its descendants and returns a detached
+// copy of the tree holding what they counted since the previous reset, which
+// starts at the previous reset time. Counters are swapped atomically, so
+// updates made concurrently are counted in either the returned copy or the
+// next one, never lost. The next window starts at start.
+//
+// Count and Duration are swapped one after the other, so a call finishing
+// during Collect may have its count and its duration land in adjacent
+// windows: totals are exact over time, but a single window's mean can be
+// slightly off under load.
+func (l *OpTrace) Collect(start time.Time) *OpTrace {
+	if l == nil {
+		return nil
+	}
+	out := &OpTrace{
+		Function:  l.Function,
+		Count:     atomic.SwapInt64(&l.Count, 0),
+		Duration:  time.Duration(atomic.SwapInt64((*int64)(&l.Duration), 0)),
+		Histogram: l.GetHistogram().collect(),
+		start:     atomic.SwapInt64(&l.start, start.UnixNano()),
+		lock:      &sync.RWMutex{},
+	}
+	for _, c := range l.GetChildren() {
+		out.Children = append(out.Children, c.Collect(start))
+	}
+	return out
 }
 
-func (l *OpTrace) Stop() *OpTrace {
-	atomic.AddInt64((*int64)(&l.Duration), int64(time.Now().Sub(l.start)))
-	return l
+// StartTime returns the time the trace was created or last reset, or the zero
+// time for a nil trace.
+func (l *OpTrace) StartTime() time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, atomic.LoadInt64(&l.start))
+}
+
+// For repeating operations: each call returns its own timer, whose Stop adds
+// the elapsed time and one count to l.
+//
+//	t := l.Start()
+//	defer t.Stop()
+func (l *OpTrace) Start() *OpTimer {
+	if l == nil {
+		return nil
+	}
+	return &OpTimer{node: l, start: time.Now()}
+}
+
+func (t *OpTimer) Stop() time.Duration {
+	if t == nil {
+		return 0
+	}
+	dur := time.Now().Sub(t.start)
+	t.node.Add(dur)
+	return dur
+}
+
+// Node returns the trace the timer adds to.
+func (t *OpTimer) Node() *OpTrace {
+	if t == nil {
+		return nil
+	}
+	return t.node
 }
 
 // TODO: prevent double counting (see: fastfilter new-ff.handleIncReqCount trace)
 func (l *OpTrace) Add(dur time.Duration) *OpTrace {
+	if l == nil {
+		return nil
+	}
 	atomic.AddInt64((*int64)(&l.Duration), int64(dur))
 	atomic.AddInt64(&l.Count, 1)
+	l.GetHistogram().Record(dur)
 	return l
 }
 
@@ -119,9 +255,68 @@ func (l *OpTrace) AddFrom(start time.Time) *OpTrace {
 	return l.Add(time.Now().Sub(start))
 }
 
+func (l *OpTrace) histogramPtr() *unsafe.Pointer {
+	return (*unsafe.Pointer)(unsafe.Pointer(&l.Histogram))
+}
+
+// GetHistogram returns the latency histogram of l, or nil if histograms are
+// not enabled.
+func (l *OpTrace) GetHistogram() *Histogram {
+	if l == nil {
+		return nil
+	}
+	return (*Histogram)(atomic.LoadPointer(l.histogramPtr()))
+}
+
+// EnableHistograms makes l and its descendants, including children added
+// later, keep a latency histogram. Calls timed before the histogram exists
+// are only counted in the totals.
+func (l *OpTrace) EnableHistograms() *OpTrace {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	atomic.CompareAndSwapPointer(l.histogramPtr(), nil, unsafe.Pointer(NewHistogram()))
+	for _, c := range l.Children {
+		c.EnableHistograms()
+	}
+	return l
+}
+
+func (l *OpTrace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Function  string        `json:"function,omitempty"`
+		Duration  time.Duration `json:"duration"`
+		Children  []*OpTrace    `json:"children,omitempty"`
+		Count     int64         `json:"count,omitempty"`
+		Histogram *Histogram    `json:"histogram,omitempty"`
+	}{
+		Function:  l.Function,
+		Duration:  time.Duration(atomic.LoadInt64((*int64)(&l.Duration))),
+		Children:  l.GetChildren(),
+		Count:     atomic.LoadInt64(&l.Count),
+		Histogram: l.GetHistogram(),
+	})
+}
+
+// MergeHistograms returns a histogram combining the histograms of traces.
+func MergeHistograms(traces ...*OpTrace) *Histogram {
+	h := NewHistogram()
+	for _, t := range traces {
+		if t != nil {
+			h.Merge(t.GetHistogram())
+		}
+	}
+	return h
+}
+
 func (l *OpTrace) addNewChild(fname string) *OpTrace {
 	child := NewOpTrace(fname)
 	if l != nil {
+		if l.GetHistogram() != nil {
+			child.Histogram = NewHistogram()
+		}
 		if l.Children == nil {
 			l.Children = []*OpTrace{}
 		}
@@ -0,0 +1,141 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+// OpTrace nodes hold aggregate totals rather than individual calls, so the
+// exporters lay children out one after another inside their parent, the way
+// a flame chart draws them.
+
+func loadDuration(t *goutil.OpTrace) time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&t.Duration)))
+}
+
+// layoutNode is a snapshot of a trace node laid out for export, built in a
+// single pass over the tree.
+type layoutNode struct {
+	t        *goutil.OpTrace
+	duration time.Duration
+	// width is the time covered by the node in the layout: its own duration,
+	// or the sum of its children's widths if they ran concurrently and add up
+	// to more.
+	width    time.Duration
+	children []*layoutNode
+}
+
+func layout(t *goutil.OpTrace) *layoutNode {
+	n := &layoutNode{t: t, duration: loadDuration(t)}
+	var sum time.Duration
+	for _, c := range t.GetChildren() {
+		child := layout(c)
+		n.children = append(n.children, child)
+		sum += child.width
+	}
+	n.width = n.duration
+	if sum > n.width {
+		n.width = sum
+	}
+	return n
+}
+
+// self returns the part of the node's duration not covered by its children.
+func (n *layoutNode) self() time.Duration {
+	self := n.duration
+	for _, c := range n.children {
+		self -= c.duration
+	}
+	if self < 0 {
+		return 0
+	}
+	return self
+}
+
+type chromeEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func chromeEvents(n *layoutNode, ts time.Duration, events []chromeEvent) []chromeEvent {
+	t := n.t
+	args := map[string]interface{}{
+		"count":    atomic.LoadInt64(&t.Count),
+		"duration": n.duration.String(),
+	}
+	if t.GetHistogram().Count() > 0 {
+		args["latency"] = t.GetHistogram().Summary()
+	}
+	events = append(events, chromeEvent{
+		Name: t.Function,
+		Cat:  "optrace",
+		Ph:   "X",
+		Ts:   micros(ts),
+		Dur:  micros(n.width),
+		Pid:  1,
+		Tid:  1,
+		Args: args,
+	})
+	for _, c := range n.children {
+		events = chromeEvents(c, ts, events)
+		ts += c.width
+	}
+	return events
+}
+
+// WriteChromeTrace writes t in the Chrome trace_event JSON format, viewable in
+// chrome://tracing or Perfetto.
+func WriteChromeTrace(w io.Writer, t *goutil.OpTrace) error {
+	out := chromeTrace{TraceEvents: []chromeEvent{}, DisplayTimeUnit: "ms"}
+	if t != nil {
+		out.TraceEvents = chromeEvents(layout(t), 0, out.TraceEvents)
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+var frameReplacer = strings.NewReplacer(";", ":", "\n", " ")
+
+func writeFolded(w *bufio.Writer, n *layoutNode, stack string) {
+	frame := frameReplacer.Replace(n.t.Function)
+	if stack != "" {
+		frame = stack + ";" + frame
+	}
+	if us := int64(n.self() / time.Microsecond); us > 0 {
+		fmt.Fprintf(w, "%s %d\n", frame, us)
+	}
+	for _, c := range n.children {
+		writeFolded(w, c, frame)
+	}
+}
+
+// WriteFolded writes t as folded stacks ("root;child;leaf <self µs>" per line)
+// for flamegraph.pl, inferno or speedscope.
+func WriteFolded(w io.Writer, t *goutil.OpTrace) error {
+	bw := bufio.NewWriter(w)
+	if t != nil {
+		writeFolded(bw, layout(t), "")
+	}
+	return bw.Flush()
+}
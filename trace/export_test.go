@@ -0,0 +1,218 @@
+package trace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+func TestWriteChromeTrace(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteChromeTrace(&buf, testTrace()); err != nil {
+		t.Fatal(err)
+	}
+	var out chromeTrace
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	type span struct {
+		name    string
+		ts, dur float64
+	}
+	var got []span
+	for _, ev := range out.TraceEvents {
+		if ev.Ph != "X" {
+			t.Errorf("%s has phase %q", ev.Name, ev.Ph)
+		}
+		got = append(got, span{ev.Name, ev.Ts, ev.Dur})
+	}
+	want := []span{{"root", 0, 5000}, {"load", 0, 3000}, {"parse", 0, 2000}, {"save", 3000, 1000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if args := out.TraceEvents[1].Args; args["count"] != 1.0 || args["duration"] != "3ms" {
+		t.Errorf("load args = %v", args)
+	}
+
+	// children running concurrently widen their parent
+	root := goutil.NewOpTrace("root")
+	root.Add(time.Millisecond)
+	root.AddNewChild("a").Add(time.Millisecond)
+	root.AddNewChild("b").Add(time.Millisecond)
+	buf.Reset()
+	if err := WriteChromeTrace(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+	out = chromeTrace{}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.TraceEvents[0].Dur != 2000 || out.TraceEvents[2].Ts != 1000 {
+		t.Errorf("events = %+v", out.TraceEvents)
+	}
+}
+
+func TestWriteFolded(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFolded(&buf, testTrace()); err != nil {
+		t.Fatal(err)
+	}
+	want := "root 1000\nroot;load 1000\nroot;load;parse 2000\nroot;save 1000\n"
+	if buf.String() != want {
+		t.Errorf("folded stacks:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	root := goutil.NewOpTrace("a;b\nc")
+	root.Add(time.Millisecond)
+	buf.Reset()
+	WriteFolded(&buf, root)
+	if got := strings.TrimSpace(buf.String()); got != "a:b c 1000" {
+		t.Errorf("escaped frame = %q", got)
+	}
+}
+
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+// parseProto splits a protobuf message into its varint and length-delimited
+// fields, the only wire types WritePprof emits.
+func parseProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("bad field key")
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("bad varint")
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatal("bad length")
+			}
+			f.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func parsePacked(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var xs []uint64
+	for len(b) > 0 {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("bad packed varint")
+		}
+		xs = append(xs, x)
+		b = b[n:]
+	}
+	return xs
+}
+
+func TestWritePprof(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePprof(&buf, testTrace()); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strs []string
+	var sampleTypes, samples [][]byte
+	functions := make(map[uint64]uint64) // id to name index
+	var duration uint64
+	for _, f := range parseProto(t, raw) {
+		switch f.num {
+		case profSampleType:
+			sampleTypes = append(sampleTypes, f.bytes)
+		case profSample:
+			samples = append(samples, f.bytes)
+		case profFunction:
+			var id, name uint64
+			for _, ff := range parseProto(t, f.bytes) {
+				switch ff.num {
+				case functionID:
+					id = ff.varint
+				case functionName:
+					name = ff.varint
+				}
+			}
+			functions[id] = name
+		case profStringTable:
+			strs = append(strs, string(f.bytes))
+		case profDurationNanos:
+			duration = f.varint
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table %q must start with the empty string", strs)
+	}
+
+	var types []string
+	for _, st := range sampleTypes {
+		fields := parseProto(t, st)
+		types = append(types, strs[fields[0].varint]+"/"+strs[fields[1].varint])
+	}
+	if want := []string{"count/count", "time/nanoseconds"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("sample types = %v, want %v", types, want)
+	}
+
+	got := make(map[string][]uint64)
+	for _, s := range samples {
+		var stack []string
+		var values []uint64
+		for _, f := range parseProto(t, s) {
+			switch f.num {
+			case sampleLocationID:
+				for _, id := range parsePacked(t, f.bytes) {
+					stack = append(stack, strs[functions[id]])
+				}
+			case sampleValue:
+				values = parsePacked(t, f.bytes)
+			}
+		}
+		got[strings.Join(stack, ";")] = values
+	}
+	ms := uint64(time.Millisecond)
+	want := map[string][]uint64{
+		"root":            {1, ms},
+		"load;root":       {1, ms},
+		"parse;load;root": {1, 2 * ms},
+		"save;root":       {1, ms},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("samples = %v, want %v", got, want)
+	}
+	if duration != 5*ms {
+		t.Errorf("duration = %d, want %d", duration, 5*ms)
+	}
+}
@@ -0,0 +1,187 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+// DebugPath is where HandleDebug serves registered traces.
+const DebugPath = "/debug/optrace"
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*goutil.OpTrace)
+)
+
+// Register makes t available to the debug handler under name, replacing any
+// trace previously registered with that name.
+func Register(name string, t *goutil.OpTrace) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = t
+}
+
+func Unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, name)
+}
+
+// Registered returns the registered trace names in sorted order.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookup(name string) *goutil.OpTrace {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[name]
+}
+
+type namedTrace struct {
+	Name  string
+	Trace *goutil.OpTrace
+}
+
+// HandleDebug registers Handler on mux at DebugPath, or on
+// http.DefaultServeMux if mux is nil.
+func HandleDebug(mux *http.ServeMux) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	mux.Handle(DebugPath, Handler())
+}
+
+// Handler serves registered traces. Query parameters:
+//
+//	name=<name>    only this trace (repeatable); all traces by default
+//	format=text    the OpTrace.String() format (default)
+//	format=json    a JSON object keyed by trace name
+//	format=html    a collapsible tree
+//	reset=1        reset the traces as they are read
+//
+// With reset, the response shows exactly what is removed by the reset, so
+// polling with reset=1 yields consecutive, non-overlapping windows.
+func Handler() http.Handler {
+	return http.HandlerFunc(serveDebug)
+}
+
+func serveDebug(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "", "text", "json", "html":
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	names := q["name"]
+	if len(names) == 0 {
+		names = Registered()
+	}
+	traces := make([]namedTrace, 0, len(names))
+	for _, name := range names {
+		t := lookup(name)
+		if t == nil {
+			http.Error(w, fmt.Sprintf("trace %q not registered", name), http.StatusNotFound)
+			return
+		}
+		traces = append(traces, namedTrace{Name: name, Trace: t})
+	}
+	// reset only once the request is known to succeed
+	if q.Get("reset") == "1" || q.Get("reset") == "true" {
+		now := time.Now()
+		for i := range traces {
+			traces[i].Trace = traces[i].Trace.Collect(now)
+		}
+	}
+
+	switch format {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, t := range traces {
+			fmt.Fprintf(w, "%s %s\n\n", t.Name, t.Trace)
+		}
+	case "json":
+		out := make(map[string]*goutil.OpTrace, len(traces))
+		for _, t := range traces {
+			out[t.Name] = t.Trace
+		}
+		b, err := json.MarshalIndent(out, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := htmlTemplate.Execute(w, traces); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+type htmlNode struct {
+	Function string
+	Duration time.Duration
+	Count    int64
+	Latency  string
+	Children []*goutil.OpTrace
+}
+
+func toHTMLNode(t *goutil.OpTrace) htmlNode {
+	n := htmlNode{
+		Function: t.Function,
+		Duration: loadDuration(t),
+		Count:    atomic.LoadInt64(&t.Count),
+		Children: t.GetChildren(),
+	}
+	if t.GetHistogram().Count() > 0 {
+		n.Latency = t.GetHistogram().String()
+	}
+	return n
+}
+
+var htmlTemplate = template.Must(template.New("optrace").Funcs(template.FuncMap{
+	"node": toHTMLNode,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>optrace</title>
+<style>
+body { font-family: monospace; }
+details { margin-left: 1.5em; }
+summary { cursor: pointer; }
+.leaf { margin-left: 2.6em; }
+.stats { color: #666; }
+</style>
+</head>
+<body>
+{{define "node"}}{{with node .}}{{if .Children}}<details open><summary>{{template "line" .}}</summary>
+{{range .Children}}{{template "node" .}}{{end}}</details>
+{{else}}<div class="leaf">{{template "line" .}}</div>
+{{end}}{{end}}{{end}}
+{{define "line"}}<b>{{.Function}}</b> <span class="stats">{{.Duration}}{{if .Count}}, count: {{.Count}}{{end}}{{if .Latency}}, {{.Latency}}{{end}}</span>{{end}}
+{{range .}}<h3>{{.Name}}</h3>
+{{template "node" .Trace}}
+{{else}}<p>no traces registered</p>
+{{end}}
+</body>
+</html>
+`))
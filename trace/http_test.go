@@ -0,0 +1,104 @@
+package trace
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+func registerTest(t *testing.T) (a, b *goutil.OpTrace) {
+	a, b = goutil.NewOpTrace("a-root"), goutil.NewOpTrace("b-root")
+	a.AddNewChild("load").Add(time.Millisecond)
+	b.Add(2 * time.Millisecond)
+	Register("a", a)
+	Register("b", b)
+	t.Cleanup(func() {
+		Unregister("a")
+		Unregister("b")
+	})
+	return a, b
+}
+
+func get(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", DebugPath+"?"+query, nil))
+	return w
+}
+
+func TestHandlerFormats(t *testing.T) {
+	registerTest(t)
+
+	w := get("")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("text: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, "a process-trace") || !strings.Contains(body, "load: 1ms") ||
+		!strings.Contains(body, "b process-trace") {
+		t.Errorf("text body:\n%s", body)
+	}
+
+	w = get("format=json&name=a")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("json: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var out map[string]*goutil.OpTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out["a"] == nil || len(out["a"].Children) != 1 || out["a"].Children[0].Duration != time.Millisecond {
+		t.Errorf("json body:\n%s", w.Body.String())
+	}
+
+	w = get("format=html&name=b")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("html: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<h3>b</h3>") || strings.Contains(body, "<h3>a</h3>") {
+		t.Errorf("html body:\n%s", body)
+	}
+
+	if w = get("format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: %d", w.Code)
+	}
+	if w = get("name=missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing name: %d", w.Code)
+	}
+}
+
+func TestHandlerReset(t *testing.T) {
+	a, b := registerTest(t)
+	load := a.GetChildren()[0]
+
+	for _, query := range []string{
+		"name=a&name=missing&reset=1",
+		"name=a&format=xml&reset=1",
+	} {
+		if w := get(query); w.Code == http.StatusOK {
+			t.Fatalf("%s succeeded", query)
+		}
+		if atomic.LoadInt64(&load.Count) != 1 {
+			t.Fatalf("failed request %s reset the trace", query)
+		}
+	}
+
+	w := get("name=a&format=json&reset=1")
+	var out map[string]*goutil.OpTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["a"].Children[0].Count != 1 {
+		t.Errorf("reset response does not hold the counts: %s", w.Body.String())
+	}
+	if atomic.LoadInt64(&load.Count) != 0 {
+		t.Error("reset=1 did not reset a")
+	}
+	if atomic.LoadInt64(&b.Count) != 1 {
+		t.Error("reset of a also reset b")
+	}
+}
@@ -0,0 +1,327 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+// Span is an OpenTelemetry-style span built from one OpTrace node. Timestamps
+// follow the same layout as the other exporters: the root starts at the time
+// the trace was created or last reset and children follow one another inside
+// their parent.
+type Span struct {
+	TraceID      TraceID                `json:"trace_id"`
+	SpanID       SpanID                 `json:"span_id"`
+	ParentSpanID SpanID                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+}
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+
+func (id SpanID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+
+// MarshalJSON leaves out parent_span_id for root spans, which omitempty does
+// not do for arrays.
+func (s Span) MarshalJSON() ([]byte, error) {
+	type span Span
+	out := struct {
+		span
+		ParentSpanID *SpanID `json:"parent_span_id,omitempty"`
+	}{span: span(s)}
+	if s.ParentSpanID.IsValid() {
+		out.ParentSpanID = &s.ParentSpanID
+	}
+	return json.Marshal(out)
+}
+
+// Span attribute keys.
+const (
+	AttrFunction = "code.function"
+	AttrCount    = "optrace.count"
+	AttrMean     = "optrace.mean_ns"
+	AttrP50      = "optrace.p50_ns"
+	AttrP90      = "optrace.p90_ns"
+	AttrP99      = "optrace.p99_ns"
+)
+
+// SpanExporter sends spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []Span) error
+	Shutdown(ctx context.Context) error
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// Spans converts t and its descendants into spans of one new trace, parents
+// before children.
+func Spans(t *goutil.OpTrace) []Span {
+	if t == nil {
+		return nil
+	}
+	var traceID TraceID
+	randomID(traceID[:])
+	return appendSpans(nil, layout(t), traceID, SpanID{}, t.StartTime())
+}
+
+func appendSpans(spans []Span, n *layoutNode, traceID TraceID, parent SpanID, start time.Time) []Span {
+	t := n.t
+	s := Span{
+		TraceID:      traceID,
+		ParentSpanID: parent,
+		Name:         t.Function,
+		Start:        start,
+		End:          start.Add(n.width),
+		Attributes: map[string]interface{}{
+			AttrFunction: t.Function,
+			AttrCount:    atomic.LoadInt64(&t.Count),
+		},
+	}
+	randomID(s.SpanID[:])
+	if count := atomic.LoadInt64(&t.Count); count > 0 {
+		s.Attributes[AttrMean] = int64(n.duration) / count
+	}
+	if t.GetHistogram().Count() > 0 {
+		sum := t.GetHistogram().Summary()
+		s.Attributes[AttrP50] = int64(sum.P50)
+		s.Attributes[AttrP90] = int64(sum.P90)
+		s.Attributes[AttrP99] = int64(sum.P99)
+	}
+	spans = append(spans, s)
+	for _, c := range n.children {
+		spans = appendSpans(spans, c, traceID, s.SpanID, start)
+		start = start.Add(c.width)
+	}
+	return spans
+}
+
+// Export converts t to spans and sends them through exp. Together with a
+// Reporter it exports one trace per reporting window:
+//
+//	trace.StartReporter(root, time.Minute, func(r *trace.Report) {
+//		trace.Export(context.Background(), exp, r.Trace)
+//	})
+func Export(ctx context.Context, exp SpanExporter, t *goutil.OpTrace) error {
+	spans := Spans(t)
+	if len(spans) == 0 {
+		return nil
+	}
+	return exp.ExportSpans(ctx, spans)
+}
+
+// JSONExporter writes spans to a writer as JSON lines, one span per line.
+type JSONExporter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w, enc: json.NewEncoder(w)}
+}
+
+// NewFileExporter returns a JSONExporter appending to the file at path; the
+// file is closed by Shutdown.
+func NewFileExporter(path string) (*JSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONExporter(f), nil
+}
+
+func (e *JSONExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		if err := e.enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *JSONExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.w.(io.Closer); ok && e.w != os.Stdout && e.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// DefaultOTLPEndpoint is the standard OTLP/HTTP traces endpoint of a local
+// collector.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// OTLPExporter posts spans to an OTLP/HTTP endpoint using the protocol's JSON
+// encoding.
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	Headers     map[string]string
+	Client      *http.Client
+}
+
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// OTLP/JSON message shapes, limited to the fields set by this package.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+const otlpSpanKindInternal = 1
+
+func otlpAttribute(k string, v interface{}) otlpKeyValue {
+	var val otlpValue
+	switch x := v.(type) {
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		val.IntValue = &s
+	case int:
+		s := strconv.Itoa(x)
+		val.IntValue = &s
+	default:
+		s := fmt.Sprint(x)
+		val.StringValue = &s
+	}
+	return otlpKeyValue{Key: k, Value: val}
+}
+
+func toOTLP(serviceName string, spans []Span) otlpRequest {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentSpanID.IsValid() {
+			o.ParentSpanID = s.ParentSpanID.String()
+		}
+		for k, v := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, v))
+		}
+		out[i] = o
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{otlpAttribute("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/alexi/goutil/trace"}, Spans: out}},
+	}}}
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	body, err := json.Marshal(toOTLP(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("otlp export: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
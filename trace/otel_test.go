@@ -0,0 +1,129 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+func testTrace() *goutil.OpTrace {
+	root := goutil.NewOpTrace("root").EnableHistograms()
+	load := root.AddNewChild("load")
+	load.Add(3 * time.Millisecond)
+	load.AddNewChild("parse").Add(2 * time.Millisecond)
+	root.AddNewChild("save").Add(time.Millisecond)
+	root.Add(5 * time.Millisecond)
+	return root
+}
+
+func TestSpans(t *testing.T) {
+	spans := Spans(testTrace())
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4", len(spans))
+	}
+	byName := make(map[string]Span)
+	for _, s := range spans {
+		if s.TraceID != spans[0].TraceID {
+			t.Errorf("span %s has trace id %s, want %s", s.Name, s.TraceID, spans[0].TraceID)
+		}
+		byName[s.Name] = s
+	}
+	if byName["root"].ParentSpanID.IsValid() {
+		t.Error("root span has a parent")
+	}
+	for child, parent := range map[string]string{"load": "root", "parse": "load", "save": "root"} {
+		if byName[child].ParentSpanID != byName[parent].SpanID {
+			t.Errorf("%s is not a child of %s", child, parent)
+		}
+	}
+	// children are laid out one after another inside the parent
+	if !byName["save"].Start.Equal(byName["load"].End) {
+		t.Errorf("save starts at %v, want end of load %v", byName["save"].Start, byName["load"].End)
+	}
+	if d := byName["root"].End.Sub(byName["root"].Start); d != 5*time.Millisecond {
+		t.Errorf("root span lasts %v, want 5ms", d)
+	}
+	if byName["load"].Attributes[AttrCount] != int64(1) {
+		t.Errorf("load count attribute = %v", byName["load"].Attributes[AttrCount])
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	exp := NewOTLPExporter(srv.URL+"/v1/traces", "test-service")
+	if err := Export(context.Background(), exp, testTrace()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("export without credentials: err = %v, want 401", err)
+	}
+	exp.Headers = map[string]string{"Authorization": "token"}
+	if err := Export(context.Background(), exp, testTrace()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request shape: %+v", got)
+	}
+	if name := got.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name == nil || *name != "test-service" {
+		t.Errorf("service.name = %v", name)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4", len(spans))
+	}
+	ids := make(map[string]string)
+	for _, s := range spans {
+		if len(s.TraceID) != 32 || len(s.SpanID) != 16 {
+			t.Errorf("span %s has malformed ids %q/%q", s.Name, s.TraceID, s.SpanID)
+		}
+		ids[s.Name] = s.SpanID
+	}
+	for _, s := range spans {
+		if s.Name == "parse" && s.ParentSpanID != ids["load"] {
+			t.Errorf("parse parent = %q, want %q", s.ParentSpanID, ids["load"])
+		}
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Export(context.Background(), NewJSONExporter(&buf), testTrace()); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("wrote %d lines, want 4", len(lines))
+	}
+	for _, line := range lines {
+		var s map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatal(err)
+		}
+		parent, ok := s["parent_span_id"]
+		if root := s["name"] == "root"; root == ok {
+			t.Errorf("%s span has parent_span_id %q", s["name"], parent)
+		}
+		if ok && len(parent.(string)) != 16 {
+			t.Errorf("%s span has parent_span_id %q", s["name"], parent)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"compress/gzip"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+// Minimal encoder for the profile.proto messages used by pprof, to avoid
+// pulling in a protobuf dependency.
+type protoBuf struct {
+	b []byte
+}
+
+func (p *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		p.b = append(p.b, byte(x)|0x80)
+		x >>= 7
+	}
+	p.b = append(p.b, byte(x))
+}
+
+func (p *protoBuf) tag(field int, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (p *protoBuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	p.tag(field, 0)
+	p.varint(x)
+}
+
+func (p *protoBuf) int64(field int, x int64) {
+	p.uint64(field, uint64(x))
+}
+
+func (p *protoBuf) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuf) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *protoBuf) packed(field int, xs []uint64) {
+	var inner protoBuf
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	p.bytes(field, inner.b)
+}
+
+func (p *protoBuf) message(field int, f func(m *protoBuf)) {
+	var inner protoBuf
+	f(&inner)
+	p.bytes(field, inner.b)
+}
+
+// profile.proto field numbers
+const (
+	profSampleType    = 1
+	profSample        = 2
+	profLocation      = 4
+	profFunction      = 5
+	profStringTable   = 6
+	profTimeNanos     = 9
+	profDurationNanos = 10
+	profPeriodType    = 11
+	profPeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+
+	functionID   = 1
+	functionName = 2
+)
+
+type pprofBuilder struct {
+	strings   []string
+	stringIdx map[string]int64
+	functions map[string]uint64
+	out       protoBuf
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	if i, ok := b.stringIdx[s]; ok {
+		return i
+	}
+	i := int64(len(b.strings))
+	b.strings = append(b.strings, s)
+	b.stringIdx[s] = i
+	return i
+}
+
+// function returns the location id of name, which doubles as its function id.
+func (b *pprofBuilder) function(name string) uint64 {
+	if id, ok := b.functions[name]; ok {
+		return id
+	}
+	id := uint64(len(b.functions) + 1)
+	b.functions[name] = id
+	nameIdx := b.str(name)
+	b.out.message(profFunction, func(m *protoBuf) {
+		m.uint64(functionID, id)
+		m.int64(functionName, nameIdx)
+	})
+	b.out.message(profLocation, func(m *protoBuf) {
+		m.uint64(locationID, id)
+		m.message(locationLine, func(l *protoBuf) {
+			l.uint64(lineFunctionID, id)
+		})
+	})
+	return id
+}
+
+func (b *pprofBuilder) valueType(field int, typ, unit string) {
+	t, u := b.str(typ), b.str(unit)
+	b.out.message(field, func(m *protoBuf) {
+		m.int64(valueTypeType, t)
+		m.int64(valueTypeUnit, u)
+	})
+}
+
+// samples adds one sample per node, with the stack listed leaf first as pprof
+// expects.
+func (b *pprofBuilder) samples(n *layoutNode, stack []uint64) {
+	stack = append([]uint64{b.function(n.t.Function)}, stack...)
+	count := atomic.LoadInt64(&n.t.Count)
+	self := n.self()
+	if count > 0 || self > 0 {
+		b.out.message(profSample, func(m *protoBuf) {
+			m.packed(sampleLocationID, stack)
+			m.packed(sampleValue, []uint64{uint64(count), uint64(self)})
+		})
+	}
+	for _, c := range n.children {
+		b.samples(c, stack)
+	}
+}
+
+// WritePprof writes t as a gzipped pprof profile with "count" and "time"
+// sample types, where time is the self time of each node, so it can be opened
+// with go tool pprof.
+func WritePprof(w io.Writer, t *goutil.OpTrace) error {
+	b := &pprofBuilder{
+		stringIdx: make(map[string]int64),
+		functions: make(map[string]uint64),
+	}
+	b.str("")
+	b.valueType(profSampleType, "count", "count")
+	b.valueType(profSampleType, "time", "nanoseconds")
+	if t != nil {
+		n := layout(t)
+		b.samples(n, nil)
+		b.out.int64(profDurationNanos, int64(n.width))
+	}
+	b.out.int64(profTimeNanos, time.Now().UnixNano())
+	b.valueType(profPeriodType, "time", "nanoseconds")
+	b.out.int64(profPeriod, 1)
+	for _, s := range b.strings {
+		b.out.string(profStringTable, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.out.b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
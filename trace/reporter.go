@@ -0,0 +1,150 @@
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexi/goutil"
+	log "github.com/alexi/goutil/log"
+)
+
+// Delta is the activity of one trace node during a reporting window.
+type Delta struct {
+	Path     string                   `json:"path"`
+	Count    int64                    `json:"count"`
+	Duration time.Duration            `json:"duration"`
+	Latency  *goutil.HistogramSummary `json:"latency,omitempty"`
+}
+
+// Mean returns the average duration per call. It is subject to the skew
+// described on OpTrace.Collect.
+func (d Delta) Mean() time.Duration {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Duration / time.Duration(d.Count)
+}
+
+// Report holds what a trace counted between Start and End. Trace is the
+// collected tree; Deltas lists its nodes that saw activity, parents first.
+type Report struct {
+	Start  time.Time       `json:"start"`
+	End    time.Time       `json:"end"`
+	Trace  *goutil.OpTrace `json:"trace"`
+	Deltas []Delta         `json:"deltas"`
+}
+
+func newReport(t *goutil.OpTrace, end time.Time) *Report {
+	r := &Report{Start: t.StartTime(), End: end, Trace: t}
+	r.addDeltas(t, "")
+	return r
+}
+
+func (r *Report) addDeltas(t *goutil.OpTrace, prefix string) {
+	path := prefix + t.Function
+	if t.Count > 0 || t.Duration > 0 {
+		d := Delta{Path: path, Count: t.Count, Duration: t.Duration}
+		if t.GetHistogram().Count() > 0 {
+			s := t.GetHistogram().Summary()
+			d.Latency = &s
+		}
+		r.Deltas = append(r.Deltas, d)
+	}
+	for _, c := range t.GetChildren() {
+		r.addDeltas(c, path+"/")
+	}
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "op-trace report %s - %s (%v):", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), r.End.Sub(r.Start))
+	for _, d := range r.Deltas {
+		fmt.Fprintf(&b, "\n\t%s: count: %d, duration: %v, mean: %v", d.Path, d.Count, d.Duration, d.Mean())
+		if d.Latency != nil {
+			fmt.Fprintf(&b, ", p50: %v, p90: %v, p99: %v, max: %v", d.Latency.P50, d.Latency.P90, d.Latency.P99, d.Latency.Max)
+		}
+	}
+	return b.String()
+}
+
+// LogReports returns a report callback writing reports to the log package at
+// the given level.
+func LogReports(level int) func(*Report) {
+	return func(r *Report) {
+		if len(r.Deltas) > 0 {
+			log.DoLog(level, r.String())
+		}
+	}
+}
+
+// Reporter periodically collects a trace, hands the counts accumulated since
+// the previous collection to a callback and resets the trace for the next
+// window.
+type Reporter struct {
+	root     *goutil.OpTrace
+	interval time.Duration
+	report   func(*Report)
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+const DefaultReportInterval = time.Minute
+
+// StartReporter reports root every interval until Stop is called. A nil report
+// func logs reports at log.LOG_INFO, and an interval <= 0 means
+// DefaultReportInterval.
+func StartReporter(root *goutil.OpTrace, interval time.Duration, report func(*Report)) *Reporter {
+	if report == nil {
+		report = LogReports(log.LOG_INFO)
+	}
+	if interval <= 0 {
+		interval = DefaultReportInterval
+	}
+	r := &Reporter{
+		root:     root,
+		interval: interval,
+		report:   report,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Flush()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Flush reports the current window immediately and starts a new one.
+func (r *Reporter) Flush() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	report := newReport(r.root.Collect(now), now)
+	r.report(report)
+	return report
+}
+
+// Stop stops the reporter after reporting the final, partial window. Further
+// calls do nothing.
+func (r *Reporter) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		<-r.done
+		r.Flush()
+	})
+}
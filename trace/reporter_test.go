@@ -0,0 +1,97 @@
+package trace
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexi/goutil"
+)
+
+func TestCollect(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	root := goutil.NewOpTrace("root")
+	root.ResetTo(start)
+	load := root.AddNewChild("load")
+	load.Add(2 * time.Millisecond)
+	load.Add(4 * time.Millisecond)
+
+	end := time.Now()
+	out := root.Collect(end)
+	if !out.StartTime().Equal(start) || !root.StartTime().Equal(end) {
+		t.Errorf("collected window starts at %v, next at %v", out.StartTime(), root.StartTime())
+	}
+	children := out.GetChildren()
+	if len(children) != 1 || children[0].Count != 2 || children[0].Duration != 6*time.Millisecond {
+		t.Fatalf("collected children = %v", children)
+	}
+	if atomic.LoadInt64(&load.Count) != 0 || load.Duration != 0 {
+		t.Error("Collect did not reset the live tree")
+	}
+	if len(root.GetChildren()) != 1 {
+		t.Error("Collect dropped the live children")
+	}
+
+	r := newReport(out, end)
+	if len(r.Deltas) != 1 {
+		t.Fatalf("deltas = %v, want only the active node", r.Deltas)
+	}
+	d := r.Deltas[0]
+	if d.Path != "root/load" || d.Count != 2 || d.Duration != 6*time.Millisecond || d.Mean() != 3*time.Millisecond {
+		t.Errorf("delta = %+v, mean %v", d, d.Mean())
+	}
+	if (Delta{}).Mean() != 0 {
+		t.Error("mean of an empty delta is not zero")
+	}
+	if s := r.String(); !strings.Contains(s, "root/load: count: 2, duration: 6ms, mean: 3ms") {
+		t.Errorf("report:\n%s", s)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	root := goutil.NewOpTrace("root")
+	reports := make(chan *Report, 100)
+	r := StartReporter(root, 10*time.Millisecond, func(rep *Report) { reports <- rep })
+
+	root.Add(time.Millisecond)
+	deadline := time.After(5 * time.Second)
+	for active := false; !active; {
+		select {
+		case rep := <-reports:
+			active = len(rep.Deltas) == 1 && rep.Deltas[0].Count == 1
+		case <-deadline:
+			t.Fatal("no report of the activity")
+		}
+	}
+
+	root.Add(time.Millisecond)
+	root.Add(time.Millisecond)
+	r.Stop()
+	var total int64
+	for len(reports) > 0 {
+		for _, d := range (<-reports).Deltas {
+			total += d.Count
+		}
+	}
+	if total != 2 {
+		t.Errorf("reports after the first counted %d calls, want 2", total)
+	}
+	r.Stop()
+	if len(reports) != 0 {
+		t.Error("second Stop reported again")
+	}
+
+	if rep := r.Flush(); len(rep.Deltas) != 0 || rep.End.Before(rep.Start) {
+		t.Errorf("Flush after Stop = %+v", rep)
+	}
+	<-reports
+}
+
+func TestReporterDefaultInterval(t *testing.T) {
+	r := StartReporter(goutil.NewOpTrace("root"), 0, func(*Report) {})
+	if r.interval != DefaultReportInterval {
+		t.Errorf("interval = %v", r.interval)
+	}
+	r.Stop()
+}
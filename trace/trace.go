@@ -0,0 +1,48 @@
+// Context propagation for goutil.OpTrace, so deep call chains can be traced
+// without passing trace nodes through every signature.
+package trace
+
+import (
+	"context"
+
+	"github.com/alexi/goutil"
+)
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying t as the parent of spans started
+// from it.
+func NewContext(ctx context.Context, t *goutil.OpTrace) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext returns the trace carried by ctx, or nil.
+func FromContext(ctx context.Context) *goutil.OpTrace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(ctxKey{}).(*goutil.OpTrace)
+	return t
+}
+
+// Start starts timing name as a child of the trace carried by ctx and returns
+// a context carrying the child along with the timer for this call. Calls with
+// the same name under one parent accumulate into a single node. If ctx carries
+// no trace, tracing is disabled: the timer is nil and stopping it is a no-op.
+//
+//	ctx, span := trace.Start(ctx, "load")
+//	defer span.Stop()
+func Start(ctx context.Context, name string) (context.Context, *goutil.OpTimer) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return ctx, nil
+	}
+	node, _ := parent.GetOrCreateChild(name)
+	return NewContext(ctx, node), node.Start()
+}
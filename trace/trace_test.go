@@ -0,0 +1,57 @@
+package trace
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alexi/goutil"
+)
+
+func TestStart(t *testing.T) {
+	root := goutil.NewOpTrace("root")
+	ctx := NewContext(context.Background(), root)
+	for i := 0; i < 2; i++ {
+		ctx1, load := Start(ctx, "load")
+		ctx2, parse := Start(ctx1, "parse")
+		if FromContext(ctx2) == FromContext(ctx1) || FromContext(ctx1) == root {
+			t.Fatal("Start did not put the child in the returned context")
+		}
+		parse.Stop()
+		load.Stop()
+	}
+	if FromContext(ctx) != root {
+		t.Fatal("Start modified the parent context")
+	}
+
+	children := root.GetChildren()
+	if len(children) != 1 || children[0].Function != "load" {
+		t.Fatalf("root children = %v, want a single load node", children)
+	}
+	load := children[0]
+	grandchildren := load.GetChildren()
+	if len(grandchildren) != 1 || grandchildren[0].Function != "parse" {
+		t.Fatalf("load children = %v, want a single parse node", grandchildren)
+	}
+	if n := atomic.LoadInt64(&load.Count); n != 2 {
+		t.Errorf("load counted %d calls, want 2", n)
+	}
+	if n := atomic.LoadInt64(&grandchildren[0].Count); n != 2 {
+		t.Errorf("parse counted %d calls, want 2", n)
+	}
+}
+
+func TestStartWithoutTrace(t *testing.T) {
+	for _, ctx := range []context.Context{context.Background(), nil} {
+		got, span := Start(ctx, "load")
+		if span != nil {
+			t.Fatal("Start without a trace returned a timer")
+		}
+		if got == nil || FromContext(got) != nil {
+			t.Fatal("Start without a trace returned a context carrying a trace")
+		}
+		if d := span.Stop(); d != 0 {
+			t.Errorf("nil timer measured %v", d)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package goutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run with -race: every operation below runs concurrently on shared nodes.
+func TestOpTraceConcurrent(t *testing.T) {
+	const goroutines = 16
+	const iterations = 500
+	root := NewOpTrace("root").EnableHistograms()
+	names := []string{"a", "b", "c", "d"}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				child, _ := root.GetOrCreateChild(names[(g+i)%len(names)])
+				timer := child.Start()
+				leaf, _ := child.GetOrCreateChild("leaf")
+				leaf.Add(time.Microsecond)
+				timer.Stop()
+				switch i % 100 {
+				case 0:
+					root.AddChild(NewOpTrace("extra"))
+				case 1:
+					_ = fmt.Sprint(root)
+				case 2:
+					if _, err := json.Marshal(root); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var count int64
+	for _, c := range root.GetChildren() {
+		if c.Function == "extra" {
+			continue
+		}
+		count += atomic.LoadInt64(&c.Count)
+		leaves := c.GetChildren()
+		if len(leaves) != 1 {
+			t.Fatalf("%s has %d leaf nodes, want 1", c.Function, len(leaves))
+		}
+		if leaves[0].Histogram.Count() != atomic.LoadInt64(&leaves[0].Count) {
+			t.Errorf("%s histogram count %d != count %d", c.Function, leaves[0].Histogram.Count(), leaves[0].Count)
+		}
+	}
+	if count != goroutines*iterations {
+		t.Errorf("counted %d timed calls, want %d", count, goroutines*iterations)
+	}
+}
+
+func TestOpTraceNil(t *testing.T) {
+	var l *OpTrace
+	child, _ := l.GetOrCreateChild("child")
+	if child == nil {
+		t.Fatal("GetOrCreateChild on nil returned nil")
+	}
+	if d := l.Start().Stop(); d != 0 {
+		t.Error("timer of nil trace measured", d)
+	}
+	l.Add(time.Second)
+	l.AddChild(NewOpTrace("child"))
+	if l.CalcDuration() != nil || l.Restart() != nil || l.Collect(time.Now()) != nil {
+		t.Error("nil trace returned a trace")
+	}
+	if !l.StartTime().IsZero() {
+		t.Error("nil trace has a start time")
+	}
+	if s := fmt.Sprint(l); !strings.Contains(s, "<nil>") {
+		t.Errorf("nil trace prints as %q", s)
+	}
+}
+
+func TestOpTraceString(t *testing.T) {
+	root := NewOpTrace("root")
+	root.AddNewChild("child").Add(time.Millisecond)
+	var byValue fmt.Stringer = *root
+	for _, s := range []string{byValue.String(), fmt.Sprint(root), fmt.Sprintf("%s", *root)} {
+		if !strings.HasPrefix(s, "process-trace: \nroot: 0s\n\tchild: 1ms, count: 1\n") {
+			t.Errorf("trace prints as %q", s)
+		}
+	}
+}
+
+func TestOpTraceResetTo(t *testing.T) {
+	root := NewOpTrace("root").EnableHistograms()
+	child := root.AddNewChild("child")
+	child.Add(time.Millisecond)
+	start := time.Now().Add(time.Hour)
+	if root.ResetTo(start) != root {
+		t.Fatal("ResetTo did not return its receiver")
+	}
+	if atomic.LoadInt64(&child.Count) != 0 || child.Duration != 0 || child.GetHistogram().Count() != 0 {
+		t.Errorf("child not reset: %v", root)
+	}
+	if kids := root.GetChildren(); len(kids) != 1 || kids[0] != child {
+		t.Error("ResetTo replaced the children")
+	}
+	if !child.StartTime().Equal(start) {
+		t.Errorf("child starts at %v, want %v", child.StartTime(), start)
+	}
+}